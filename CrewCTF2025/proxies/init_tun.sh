@@ -6,6 +6,7 @@ echo "[init_tun] Setting up tun0 interface..."
 # Create tun0
 ip tuntap add dev tun0 mode tun
 ip addr add 10.0.0.1/24 dev tun0
+ip -6 addr add fd00::1/64 dev tun0
 ip link set dev tun0 up
 
 echo "[init_tun] tun0 created successfully."
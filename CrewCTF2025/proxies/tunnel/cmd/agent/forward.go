@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tunneling/pkg/protocol"
+)
+
+// FORWARD_RESPONSE_TIMEOUT bounds the wait for the proxy to connect a remote
+// forward.
+const FORWARD_RESPONSE_TIMEOUT = 30 * time.Second
+
+// remoteListeners are the listeners of the proxy's remote forwards, by
+// forward ID. pendingForwards are the accepted connections waiting for their
+// ForwardResponse, by stream ID.
+var (
+	remoteListeners = make(map[uint32]net.Listener)
+	pendingForwards = make(map[uint32]chan bool)
+	forwardsMu      sync.Mutex
+)
+
+func handleListenRequest(sender *protocol.Sender, m *protocol.ListenRequest) {
+	ln, err := net.Listen("tcp", m.Addr)
+	if err != nil {
+		slog.Error("Cannot listen for remote forward", "addr", m.Addr, "err", err)
+		_ = sender.SendListenResponse(m.ID, false)
+		return
+	}
+	forwardsMu.Lock()
+	if old := remoteListeners[m.ID]; old != nil {
+		old.Close()
+	}
+	remoteListeners[m.ID] = ln
+	forwardsMu.Unlock()
+	slog.Info("Listening for remote forward", "addr", ln.Addr(), "ID", m.ID)
+	if err := sender.SendListenResponse(m.ID, true); err != nil {
+		slog.Error("Failed to send ListenResponse", "err", err)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Remote forward accept failed", "addr", ln.Addr(), "err", err)
+			}
+			return
+		}
+		go forwardConn(sender, m.ID, conn)
+	}
+}
+
+// forwardConn carries a connection accepted for the remote forward listenID
+// to the proxy.
+func forwardConn(sender *protocol.Sender, listenID uint32, conn net.Conn) {
+	respCh := make(chan bool, 1)
+	stream := newForwardStream(sender, respCh)
+	giveUp := func() {
+		forwardsMu.Lock()
+		delete(pendingForwards, stream.ID)
+		forwardsMu.Unlock()
+		conn.Close()
+		removeConnection(stream.ID)
+	}
+
+	if err := sender.SendForwardRequest(stream.ID, listenID); err != nil {
+		slog.Error("Failed to send ForwardRequest", "err", err)
+		giveUp()
+		return
+	}
+
+	timer := time.NewTimer(FORWARD_RESPONSE_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case ok := <-respCh:
+		if ok {
+			slog.Info("Remote forward connected", "from", conn.RemoteAddr(), "ID", stream.ID)
+			err := protocol.Pipe(conn, stream)
+			slog.Info("Connection closed", "ID", stream.ID, "err", err)
+			return
+		}
+		slog.Error("Proxy refused remote forward", "from", conn.RemoteAddr(), "ID", stream.ID)
+		giveUp()
+	case <-timer.C:
+		slog.Error("Timeout waiting for ForwardResponse", "ID", stream.ID)
+		giveUp()
+		// The response may have been dispatched while the timer fired
+		select {
+		case ok := <-respCh:
+			if ok {
+				_ = sender.SendCloseRequest(stream.ID)
+			}
+		default:
+		}
+	}
+}
+
+// newForwardStream registers the stream of an accepted connection before the
+// proxy knows about it, so nothing the proxy sends right after accepting is
+// lost.
+func newForwardStream(sender *protocol.Sender, respCh chan bool) *protocol.Stream {
+	stream := newConnection(sender)
+	forwardsMu.Lock()
+	pendingForwards[stream.ID] = respCh
+	forwardsMu.Unlock()
+	return stream
+}
+
+func dispatchForwardResponse(sender *protocol.Sender, m *protocol.ForwardResponse) {
+	forwardsMu.Lock()
+	ch, ok := pendingForwards[m.ID]
+	delete(pendingForwards, m.ID)
+	forwardsMu.Unlock()
+	if !ok {
+		slog.Warn("No pending forward for ForwardResponse", "ID", m.ID)
+		if m.Ok {
+			// The connection was given up already, the proxy has to drop
+			// its side
+			_ = sender.SendCloseRequest(m.ID)
+		}
+		return
+	}
+	ch <- m.Ok
+}
+
+// closeRemoteListeners stops the remote forwards of an expired session, the
+// proxy asks again on the next one.
+func closeRemoteListeners() {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+	for id, ln := range remoteListeners {
+		ln.Close()
+		delete(remoteListeners, id)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/tunneling/pkg/protocol"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const ECHO_TIMEOUT = 3 * time.Second
+
+func handleEchoRequest(sender *protocol.Sender, m *protocol.EchoRequest) {
+	ip := net.IP(m.IP)
+	if m.Host != "" {
+		addr, err := net.ResolveIPAddr("ip", m.Host)
+		if err != nil {
+			slog.Error("Cannot resolve echo target", "host", m.Host, "err", err)
+			_ = sender.SendEchoReply(m.ID, false)
+			return
+		}
+		ip = addr.IP
+	}
+	ok := echo(ip, m.Data)
+	if err := sender.SendEchoReply(m.ID, ok); err != nil {
+		slog.Error("Failed to send EchoReply", "err", err)
+	}
+}
+
+// echo pings ip once and reports whether a matching reply came back within
+// ECHO_TIMEOUT, using ICMPv6 for IPv6 targets. It prefers unprivileged ping
+// sockets and falls back to a raw socket.
+func echo(ip net.IP, data []byte) bool {
+	network, rawNetwork, laddr := "udp4", "ip4:icmp", "0.0.0.0"
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, rawNetwork, laddr = "udp6", "ip6:ipv6-icmp", "::"
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	conn, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		conn, err = icmp.ListenPacket(rawNetwork, laddr)
+		dst = &net.IPAddr{IP: ip}
+	}
+	if err != nil {
+		slog.Error("Cannot open ICMP socket", "err", err)
+		return false
+	}
+	defer conn.Close()
+
+	seq := int(rand.Uint32() & 0xffff)
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{
+			ID:   int(rand.Uint32() & 0xffff),
+			Seq:  seq,
+			Data: data,
+		},
+	}
+	wb, err := msg.Marshal(nil)
+	if err != nil {
+		return false
+	}
+	if _, err := conn.WriteTo(wb, dst); err != nil {
+		slog.Error("Failed to send echo", "ip", ip, "err", err)
+		return false
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ECHO_TIMEOUT))
+	rb := make([]byte, 65535)
+	for {
+		n, peer, err := conn.ReadFrom(rb)
+		if err != nil {
+			slog.Info("No echo reply", "ip", ip, "err", err)
+			return false
+		}
+		reply, err := icmp.ParseMessage(replyType.Protocol(), rb[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		body, ok := reply.Body.(*icmp.Echo)
+		// Ping sockets rewrite the identifier, match on sequence and data
+		if !ok || body.Seq != seq || !bytes.Equal(body.Data, data) {
+			continue
+		}
+		slog.Debug("Echo reply", "from", peer)
+		return true
+	}
+}
@@ -1,18 +1,64 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 
 	"github.com/tunneling/pkg/config"
 	"github.com/tunneling/pkg/protocol"
+	"github.com/tunneling/pkg/transport"
 	"github.com/tunneling/pkg/util"
 )
 
-var connections = make(map[uint32]net.Conn)
+var (
+	connections   = make(map[uint32]*protocol.Stream)
+	connectionsMu sync.Mutex
+)
+
+func getConnection(id uint32) *protocol.Stream {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	return connections[id]
+}
+
+func allConnections() []*protocol.Stream {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	streams := make([]*protocol.Stream, 0, len(connections))
+	for _, stream := range connections {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// newConnection registers a stream under an ID no other connection of the
+// agent uses, whichever side opened it.
+func newConnection(sender *protocol.Sender) *protocol.Stream {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	// 0 is the ID of a refused ConnectResponse
+	id := rand.Uint32()
+	for _, exists := connections[id]; exists || id == 0; _, exists = connections[id] {
+		id = rand.Uint32()
+	}
+	stream := protocol.NewStream(id, sender, removeConnection)
+	connections[id] = stream
+	return stream
+}
+
+func removeConnection(id uint32) {
+	connectionsMu.Lock()
+	delete(connections, id)
+	connectionsMu.Unlock()
+}
 
 func main() {
 	serverAddr := os.Getenv("SERVER_ADDR")
@@ -20,110 +66,163 @@ func main() {
 		fmt.Println("SERVER_ADDR environment variable not set")
 		os.Exit(1)
 	}
-	name := config.AgentName
-
-	conn, err := net.Dial("tcp", serverAddr)
+	// SERVER_ADDR is host:port for TCP or a ws:// or wss:// URL
+	tr, serverAddr, err := transport.ForServer(serverAddr)
 	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+		log.Fatalf("SERVER_ADDR: %v", err)
+	}
+	tlsConfig, err := loadTLSConfig(serverAddr)
+	if err != nil {
+		log.Fatalf("TLS: %v", err)
+	}
+	noiseKeys, err := loadNoiseKeys()
+	if err != nil {
+		log.Fatalf("Noise: %v", err)
+	}
+	if tlsConfig != nil && noiseKeys != nil {
+		log.Fatalf("TLS and Noise are exclusive")
+	}
+	name := os.Getenv("AGENT_NAME")
+	if name == "" && tlsConfig != nil {
+		name = certName(tlsConfig)
+	}
+	if name == "" {
+		name = config.AgentName
 	}
-	defer conn.Close()
-	log.Printf("Connected to %s", serverAddr)
 
-	// Send name + newline
-	fmt.Fprintf(conn, "%s\n", name)
-	log.Printf("Sent name: %s", name)
-	handleConn(conn)
+	s := &proxySession{
+		name:      name,
+		token:     os.Getenv("AGENT_TOKEN"),
+		transport: tr,
+		tls:       tlsConfig,
+		noise:     noiseKeys,
+	}
+	if err := s.run(serverAddr); err != nil {
+		log.Fatalf("%v", err)
+	}
 }
 
-func handleConn(conn net.Conn) {
-	defer conn.Close()
-
-	dec := protocol.NewDecoder(conn)
+// handleConn dispatches the messages of one connection until it is lost.
+func handleConn(r io.Reader, sender *protocol.Sender) error {
+	dec := protocol.NewDecoder(r)
+	dec.SetMaxFrameSize(config.MaxFrameSize)
 
 	for {
 		if err := dec.Decode(); err != nil {
-			log.Fatalf("Decode failed: %v", err)
-			continue
+			if errors.Is(err, protocol.ErrUnknownMessage) {
+				slog.Warn("Skipping frame", "err", err)
+				continue
+			}
+			return err
 		}
 
-		// Copy the payload to avoid reuse issues in concurrent goroutines
-		msg := dec.Payload
-
-		go func(payload interface{}) {
-			switch m := payload.(type) {
-			case *protocol.ConnectRequest:
-				addr, err := util.GetAddrPort(m.IP, m.Port)
-				if err != nil {
-					slog.Error("Cannot get AddrPort", "err", err)
-					return
-				}
-				slog.Info("Receive", "ConnectRequest", addr)
-
-				outConn, err := net.Dial("tcp", addr.String())
-				if err != nil {
-					slog.Error("Failed to connect to", "addr", addr, "err", err)
-					_ = protocol.SendConnectResponse(conn, false, 0)
-					return
-				}
-
-				connID := util.GenerateConnID(int(m.Port))
-				connections[connID] = outConn
-				if err := protocol.SendConnectResponse(conn, true, connID); err != nil {
-					slog.Error("Failed to send ConnectResponse", "err", err)
-					outConn.Close()
-					delete(connections, connID)
-					return
-				}
-				slog.Info("Connected", "addr", addr, "ID", connID)
-
-				go func(id uint32, serverConn net.Conn) {
-					buf := make([]byte, 32*1024)
-					for {
-						n, err := serverConn.Read(buf)
-						if err != nil {
-							slog.Info("Connection closed", "ID", id, "err", err)
-							serverConn.Close()
-							delete(connections, id)
-							return
-						}
-
-						if err := protocol.SendDataPacket(conn, id, buf[:n]); err != nil {
-							slog.Info("Failed to send DataPacket back", "err", err)
-							serverConn.Close()
-							delete(connections, id)
-							return
-						}
-					}
-				}(connID, outConn)
-
-			case *protocol.DataPacket:
-				outConn, ok := connections[m.ID]
-				if !ok {
-					slog.Error("No connection for", "ID", m.ID)
-					return
-				}
-				if _, err := outConn.Write(m.Data); err != nil {
-					slog.Error("Write to connection failed", "ID", m.ID, "err", err)
-					outConn.Close()
-					delete(connections, m.ID)
-				}
-
-			case *protocol.CloseRequest:
-				outConn, ok := connections[m.ID]
-				if !ok {
-					slog.Error("No connection to close for", "ID", m.ID)
-					return
-				}
-				slog.Info("Closing connection by request", "ID", m.ID)
-				outConn.Close()
-				delete(connections, m.ID)
-
-			case *protocol.PingRequest:
-				slog.Info("Got ping")
-
-			default:
-				slog.Error("Unknown packet", "type", fmt.Sprintf("%T", m))
+		switch m := dec.Payload.(type) {
+		case *protocol.ConnectRequest:
+			// Dialing may take a while, don't hold up the other streams
+			go handleConnectRequest(sender, m)
+
+		case *protocol.DataPacket:
+			stream := getConnection(m.ID)
+			if stream == nil {
+				slog.Error("No connection for", "ID", m.ID)
+				continue
+			}
+			if err := stream.Deliver(m.Data); errors.Is(err, protocol.ErrWindowExceeded) {
+				slog.Error("Dropping connection", "ID", m.ID, "err", err)
+				stream.Reset()
+			}
+
+		case *protocol.WindowUpdate:
+			if stream := getConnection(m.ID); stream != nil {
+				stream.AddCredit(m.Increment)
+			}
+
+		case *protocol.CloseRequest:
+			stream := getConnection(m.ID)
+			if stream == nil {
+				slog.Error("No connection to close for", "ID", m.ID)
+				continue
 			}
-		}(msg)
+			slog.Info("Closing connection by request", "ID", m.ID)
+			stream.CloseWithError(protocol.ErrStreamClosed)
+
+		case *protocol.CloseWriteRequest:
+			if stream := getConnection(m.ID); stream != nil {
+				stream.RemoteCloseWrite()
+			}
+
+		case *protocol.ResetRequest:
+			if stream := getConnection(m.ID); stream != nil {
+				slog.Info("Resetting connection by request", "ID", m.ID)
+				stream.CloseWithError(protocol.ErrStreamReset)
+			}
+
+		case *protocol.Datagram:
+			handleDatagram(sender, m)
+
+		case *protocol.DatagramClose:
+			closeUDPSession(sender, m.ID, false)
+
+		case *protocol.EchoRequest:
+			go handleEchoRequest(sender, m)
+
+		case *protocol.ResumeState:
+			protocol.ResumeStreams(sender, allConnections(), m)
+
+		case *protocol.ListenRequest:
+			go handleListenRequest(sender, m)
+
+		case *protocol.ForwardResponse:
+			dispatchForwardResponse(sender, m)
+
+		case *protocol.PingRequest:
+			slog.Info("Got ping")
+
+		default:
+			slog.Error("Unknown packet", "type", fmt.Sprintf("%T", m))
+		}
+	}
+}
+
+func handleConnectRequest(sender *protocol.Sender, m *protocol.ConnectRequest) {
+	addr, err := targetAddr(m.IP, m.Host, m.Port)
+	if err != nil {
+		slog.Error("Cannot get AddrPort", "err", err)
+		_ = sender.SendConnectResponse(false, 0, m.ID)
+		return
+	}
+	slog.Info("Receive", "ConnectRequest", addr)
+
+	outConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		slog.Error("Failed to connect to", "addr", addr, "err", err)
+		_ = sender.SendConnectResponse(false, 0, m.ID)
+		return
+	}
+
+	stream := newConnection(sender)
+	connID := stream.ID
+	if err := sender.SendConnectResponse(true, connID, m.ID); err != nil {
+		slog.Error("Failed to send ConnectResponse", "err", err)
+		outConn.Close()
+		removeConnection(connID)
+		return
+	}
+	slog.Info("Connected", "addr", addr, "ID", connID)
+
+	err = protocol.Pipe(outConn, stream)
+	slog.Info("Connection closed", "ID", connID, "err", err)
+}
+
+// targetAddr returns the host:port to dial for a target sent by the proxy,
+// which names either an IP or a host for the agent to resolve.
+func targetAddr(ip []byte, host string, port uint16) (string, error) {
+	if host != "" {
+		return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+	}
+	addr, err := util.GetAddrPort(ip, port)
+	if err != nil {
+		return "", err
 	}
+	return addr.String(), nil
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/tunneling/pkg/noise"
+)
+
+// loadTLSConfig builds the agent side of mutual TLS from AGENT_TLS_CA,
+// AGENT_TLS_CERT and AGENT_TLS_KEY. It returns nil if AGENT_TLS_CERT is not
+// set, the link is then in cleartext.
+func loadTLSConfig(serverAddr string) (*tls.Config, error) {
+	certFile := os.Getenv("AGENT_TLS_CERT")
+	if certFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, os.Getenv("AGENT_TLS_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	caFile := os.Getenv("AGENT_TLS_CA")
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in CA file %s", caFile)
+	}
+
+	serverName := os.Getenv("AGENT_TLS_SERVER_NAME")
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(serverAddr)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// certName returns the subject common name of the agent's own certificate,
+// which the proxy takes as its name.
+func certName(cfg *tls.Config) string {
+	if len(cfg.Certificates) == 0 || cfg.Certificates[0].Leaf == nil {
+		return ""
+	}
+	return cfg.Certificates[0].Leaf.Subject.CommonName
+}
+
+// noiseKeys is the agent side of the Noise handshake.
+type noiseKeys struct {
+	static noise.KeyPair
+	proxy  noise.Key
+}
+
+// loadNoiseKeys reads the agent's private key from AGENT_NOISE_KEY and the
+// pinned proxy public key from AGENT_NOISE_PROXY_KEY. It returns nil if
+// AGENT_NOISE_KEY is not set.
+func loadNoiseKeys() (*noiseKeys, error) {
+	privateKey := os.Getenv("AGENT_NOISE_KEY")
+	if privateKey == "" {
+		return nil, nil
+	}
+	private, err := noise.ParseKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("AGENT_NOISE_KEY: %w", err)
+	}
+	static, err := noise.NewKeyPair(private)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := noise.ParseKey(os.Getenv("AGENT_NOISE_PROXY_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("AGENT_NOISE_PROXY_KEY: %w", err)
+	}
+	return &noiseKeys{static: static, proxy: proxy}, nil
+}
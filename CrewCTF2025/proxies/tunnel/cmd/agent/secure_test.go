@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/tunneling/internal/testpki"
+)
+
+// serveTLS accepts TLS connections with cert, asking for any client
+// certificate, until the test ends.
+func serveTLS(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTLSServerVerification(t *testing.T) {
+	ca, other := testpki.NewCA(t, "agents"), testpki.NewCA(t, "other")
+	certPEM, keyPEM := ca.Issue(t, "agent-1", x509.ExtKeyUsageClientAuth)
+	t.Setenv("AGENT_TLS_CA", testpki.WriteFile(t, "ca.pem", ca.PEM))
+	t.Setenv("AGENT_TLS_CERT", testpki.WriteFile(t, "cert.pem", certPEM))
+	t.Setenv("AGENT_TLS_KEY", testpki.WriteFile(t, "key.pem", keyPEM))
+
+	tests := []struct {
+		name       string
+		ca         *testpki.CA
+		hosts      []string
+		serverName string
+		wantErr    bool
+	}{
+		{"matching", ca, []string{"proxy.test"}, "proxy.test", false},
+		{"other name", ca, []string{"other.test"}, "proxy.test", true},
+		{"other CA", other, []string{"proxy.test"}, "proxy.test", true},
+		// Without AGENT_TLS_SERVER_NAME, the host of the address is checked
+		{"address host", ca, []string{"proxy.test"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveTLS(t, tt.ca.TLSCert(t, "proxy", x509.ExtKeyUsageServerAuth, tt.hosts...))
+			t.Setenv("AGENT_TLS_SERVER_NAME", tt.serverName)
+			cfg, err := loadTLSConfig(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name := certName(cfg); name != "agent-1" {
+				t.Errorf("got agent name %q, want %q", name, "agent-1")
+			}
+
+			conn, err := tls.Dial("tcp", addr, cfg)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("handshake succeeded, want the server refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestTLSDisabled(t *testing.T) {
+	t.Setenv("AGENT_TLS_CERT", "")
+	cfg, err := loadTLSConfig(net.JoinHostPort("127.0.0.1", "1"))
+	if cfg != nil || err != nil {
+		t.Errorf("got %v, %v, want no TLS", cfg, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/noise"
+	"github.com/tunneling/pkg/protocol"
+	"github.com/tunneling/pkg/transport"
+)
+
+const (
+	RECONNECT_MIN_DELAY = 500 * time.Millisecond
+	RECONNECT_MAX_DELAY = 30 * time.Second
+	HANDSHAKE_TIMEOUT   = 10 * time.Second
+)
+
+var (
+	errUnauthorized   = errors.New("unauthorized by proxy")
+	errRejected       = errors.New("rejected by proxy")
+	errSessionExpired = errors.New("session expired")
+)
+
+// proxySession is the agent's side of its session with the proxy. The sender and
+// the streams outlive a lost connection, so a reconnection within
+// config.SessionResumeTimeout picks them up where they were.
+type proxySession struct {
+	name      string
+	token     string
+	transport transport.Transport
+	tls       *tls.Config
+	noise     *noiseKeys
+
+	id     string
+	sender *protocol.Sender
+	lost   time.Time
+}
+
+// run keeps the agent connected, reconnecting with a jittered exponential
+// backoff. It only returns if the proxy does not accept the agent's
+// credentials, other rejections such as a duplicate name may not last.
+func (s *proxySession) run(serverAddr string) error {
+	delay := RECONNECT_MIN_DELAY
+	for {
+		connected, err := s.connect(serverAddr)
+		if errors.Is(err, errUnauthorized) {
+			return err
+		}
+		if connected {
+			delay = RECONNECT_MIN_DELAY
+		}
+		// Sleep between half and all of delay so agents cut off together do
+		// not all come back at once
+		wait := delay/2 + rand.N(delay/2+1)
+		slog.Error("Disconnected from proxy", "err", err, "retry_in", wait)
+		time.Sleep(wait)
+		delay = min(delay*2, RECONNECT_MAX_DELAY)
+	}
+}
+
+// connect runs one connection to the proxy until it is lost and reports
+// whether the handshake went through.
+func (s *proxySession) connect(serverAddr string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HANDSHAKE_TIMEOUT)
+	defer cancel()
+	conn, err := s.transport.Dial(ctx, serverAddr)
+	if err != nil {
+		return false, err
+	}
+	if s.tls != nil {
+		tlsConn := tls.Client(conn, s.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return false, err
+		}
+		conn = tlsConn
+	}
+	if s.noise != nil {
+		conn = noise.Client(conn, s.noise.static, s.noise.proxy)
+	}
+	defer conn.Close()
+	slog.Info("Connected", "server", serverAddr)
+
+	if s.id != "" && time.Since(s.lost) > config.SessionResumeTimeout {
+		s.expire()
+	}
+
+	// Send name, token and the session to resume + newline, and wait for the
+	// proxy to accept them
+	hello := s.name
+	if s.token != "" {
+		hello += " " + s.token
+	}
+	if s.id != "" {
+		hello += " resume=" + s.id
+	}
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	if _, err := fmt.Fprintf(conn, "%s\n", hello); err != nil {
+		return false, err
+	}
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("failed to read handshake answer: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	fields := strings.Fields(status)
+	if len(fields) != 2 || fields[0] != "OK" {
+		reason := strings.TrimPrefix(strings.TrimSpace(status), "ERR ")
+		if reason == "unauthorized" {
+			return false, errUnauthorized
+		}
+		return false, fmt.Errorf("%w: %s", errRejected, reason)
+	}
+
+	if s.id != "" && fields[1] == s.id {
+		slog.Info("Resuming session")
+		s.sender.Attach(conn)
+		if err := s.sender.SendResumeState(allConnections()); err != nil {
+			return true, err
+		}
+	} else {
+		s.expire()
+		s.id = fields[1]
+		s.sender = protocol.NewSender(conn)
+		s.sender.SetMaxFrameSize(config.MaxFrameSize)
+	}
+
+	err = handleConn(reader, s.sender)
+	s.sender.Pause()
+	s.lost = time.Now()
+	closeUDPSessions()
+	return true, err
+}
+
+// expire drops the session and its streams, the proxy no longer knows them.
+func (s *proxySession) expire() {
+	if s.sender == nil {
+		return
+	}
+	s.sender.Fail(errSessionExpired)
+	closeRemoteListeners()
+	for _, stream := range allConnections() {
+		stream.CloseWithError(protocol.ErrStreamReset)
+	}
+	s.id = ""
+	s.sender = nil
+}
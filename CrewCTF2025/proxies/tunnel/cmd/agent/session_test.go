@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/tunneling/pkg/transport"
+)
+
+// A duplicate name may go away, the agent keeps trying until the proxy
+// refuses its credentials.
+func TestRunRetriesUntilUnauthorized(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	answers := []string{"ERR duplicate name", "ERR duplicate name", "ERR unauthorized"}
+	go func() {
+		for _, answer := range answers {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			fmt.Fprintf(conn, "%s\n", answer)
+			conn.Close()
+		}
+	}()
+
+	s := &proxySession{name: "agent-1", transport: transport.TCP{}}
+	if err := s.run(ln.Addr().String()); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("got error %v, want %v", err, errUnauthorized)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tunneling/pkg/protocol"
+)
+
+const UDP_IDLE_TIMEOUT = 60 * time.Second
+const UDP_MAX_DATAGRAM_SIZE = 65535
+
+// udpSession is the agent side of a UDP flow: a socket connected to the
+// target, closed after UDP_IDLE_TIMEOUT without traffic.
+type udpSession struct {
+	conn *net.UDPConn
+	idle *time.Timer
+}
+
+var (
+	udpSessions   = make(map[uint32]*udpSession)
+	udpSessionsMu sync.Mutex
+)
+
+func handleDatagram(sender *protocol.Sender, m *protocol.Datagram) {
+	udpSessionsMu.Lock()
+	session, ok := udpSessions[m.ID]
+	udpSessionsMu.Unlock()
+
+	if !ok {
+		target, err := targetAddr(m.IP, m.Host, m.Port)
+		if err != nil {
+			slog.Error("Cannot get AddrPort", "err", err)
+			_ = sender.SendDatagramClose(m.ID)
+			return
+		}
+		addr, err := net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			slog.Error("Cannot resolve UDP target", "target", target, "err", err)
+			_ = sender.SendDatagramClose(m.ID)
+			return
+		}
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			slog.Error("Failed to open UDP socket to", "addr", addr, "err", err)
+			_ = sender.SendDatagramClose(m.ID)
+			return
+		}
+		id := m.ID
+		session = &udpSession{
+			conn: conn,
+			idle: time.AfterFunc(UDP_IDLE_TIMEOUT, func() {
+				slog.Info("UDP session idle, closing", "ID", id)
+				closeUDPSession(sender, id, true)
+			}),
+		}
+		udpSessionsMu.Lock()
+		udpSessions[id] = session
+		udpSessionsMu.Unlock()
+		slog.Info("UDP session opened", "addr", addr, "ID", id)
+
+		go readDatagrams(sender, id, session)
+	}
+
+	session.idle.Reset(UDP_IDLE_TIMEOUT)
+	if _, err := session.conn.Write(m.Data); err != nil {
+		slog.Error("Write to UDP socket failed", "ID", m.ID, "err", err)
+	}
+}
+
+func readDatagrams(sender *protocol.Sender, id uint32, session *udpSession) {
+	buf := make([]byte, UDP_MAX_DATAGRAM_SIZE)
+	for {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Connected UDP sockets report ICMP errors on read, the session
+			// stays usable
+			slog.Debug("UDP read failed", "ID", id, "err", err)
+			continue
+		}
+		session.idle.Reset(UDP_IDLE_TIMEOUT)
+		if err := sender.SendDatagram(id, nil, "", 0, buf[:n]); err != nil {
+			slog.Error("Failed to send Datagram back", "ID", id, "err", err)
+			closeUDPSession(sender, id, false)
+			return
+		}
+	}
+}
+
+// closeUDPSession drops the session, notify tells the proxy about it.
+func closeUDPSession(sender *protocol.Sender, id uint32, notify bool) {
+	udpSessionsMu.Lock()
+	session, ok := udpSessions[id]
+	delete(udpSessions, id)
+	udpSessionsMu.Unlock()
+	if !ok {
+		return
+	}
+	session.idle.Stop()
+	session.conn.Close()
+	if notify {
+		_ = sender.SendDatagramClose(id)
+	}
+}
+
+// closeUDPSessions drops every session, the proxy ends its own side when the
+// connection is lost.
+func closeUDPSessions() {
+	udpSessionsMu.Lock()
+	ids := make([]uint32, 0, len(udpSessions))
+	for id := range udpSessions {
+		ids = append(ids, id)
+	}
+	udpSessionsMu.Unlock()
+	for _, id := range ids {
+		closeUDPSession(nil, id, false)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tunneling/pkg/noise"
+)
+
+// noisekey prints a new Noise static key pair, for the proxy's noise
+// private_key or an agent's AGENT_NOISE_KEY and public_key entry.
+func main() {
+	kp, err := noise.GenerateKeyPair()
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	fmt.Printf("private: %s\npublic:  %s\n", kp.Private, kp.Public)
+}
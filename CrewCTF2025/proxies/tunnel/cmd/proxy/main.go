@@ -3,41 +3,174 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/tunneling/pkg/classify"
 	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
 	"github.com/tunneling/pkg/handler"
 	"github.com/tunneling/pkg/listener"
+	"github.com/tunneling/pkg/mapping"
 	"github.com/tunneling/pkg/netstack"
+	"github.com/tunneling/pkg/noise"
+	"github.com/tunneling/pkg/routing"
+	"github.com/tunneling/pkg/transport"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
 
 func main() {
 	procCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	err := listener.SpawnListener(procCtx, "0.0.0.0:19001")
+	cfg, err := config.Load(os.Getenv("PROXY_CONFIG"))
 	if err != nil {
-		log.Panicf("Error spawning listener: %s", err)
+		log.Panicf("Error loading config: %s", err)
+	}
+	mapper, err := mapping.New(cfg.Destinations)
+	if err != nil {
+		log.Panicf("Error in destination mapping: %s", err)
+	}
+
+	rules, err := filter.Load(cfg.Rules)
+	if err != nil {
+		log.Panicf("Error in filter rules: %s", err)
+	}
+	filters := filter.NewPipeline(rules)
+
+	registry, err := listener.NewRegistry(cfg, filters)
+	if err != nil {
+		log.Panicf("Error in agent registry: %s", err)
+	}
+
+	var secure func(net.Listener) net.Listener
+	switch {
+	case cfg.TLS != nil && cfg.Noise != nil:
+		log.Panicf("Error in config: tls and noise are exclusive")
+	case cfg.TLS != nil:
+		tlsConfig, err := listener.ServerTLSConfig(cfg.TLS)
+		if err != nil {
+			log.Panicf("Error in TLS config: %s", err)
+		}
+		secure = listener.TLSListener(tlsConfig)
+	case cfg.Noise != nil:
+		private, err := noise.ParseKey(cfg.Noise.PrivateKey)
+		if err != nil {
+			log.Panicf("Error in Noise config: %s", err)
+		}
+		static, err := noise.NewKeyPair(private)
+		if err != nil {
+			log.Panicf("Error in Noise config: %s", err)
+		}
+		log.Printf("Noise public key: %s", static.Public)
+		secure = listener.NoiseListener(static, registry)
+	}
+
+	for _, t := range cfg.Transports {
+		ln, err := transport.Listen(t)
+		if err != nil {
+			log.Panicf("Error opening %s transport on %s: %s", t.Type, t.Listen, err)
+		}
+		if err := listener.SpawnListener(procCtx, ln, registry, secure); err != nil {
+			log.Panicf("Error spawning listener: %s", err)
+		}
+		log.Printf("Agents attach over %s on %s", t.Type, ln.Addr())
+	}
+
+	routes, err := routing.New(cfg)
+	if err != nil {
+		log.Panicf("Error in routes: %s", err)
+	}
+	policy, err := classify.NewPolicy(cfg.Protocols)
+	if err != nil {
+		log.Panicf("Error in protocol rules: %s", err)
 	}
 
-	s, err := netstack.New(config.TUNName, config.AgentName)
+	s, err := netstack.New(config.TUNName, routes)
 	if err != nil {
 		log.Panicf("Error: %v", err)
 	}
 	ustack, nicID, dev, linkEP := s.Ustack, s.NicID, s.Dev, s.LinkEP
 
-	tcpFwd, err := handler.TCPHandler(ustack, nicID, procCtx, s.ClientName)
+	tcpFwd, err := handler.TCPHandler(ustack, nicID, procCtx, s.Routes, mapper, filters, policy)
 	if err != nil {
 		log.Panicf("Error TCP Forwarder: %v", err)
 	}
 	ustack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
 
-	go netstack.ForwardTunnelToEndpoint(procCtx, dev, linkEP)
+	udpFwd, err := handler.UDPHandler(ustack, nicID, procCtx, s.Routes, mapper)
+	if err != nil {
+		log.Panicf("Error UDP Forwarder: %v", err)
+	}
+	ustack.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+
+	icmpHandler := handler.NewICMPHandler(s.Routes, mapper, func(packet []byte) error {
+		return netstack.WritePacket(dev, packet)
+	})
+
+	if cfg.SOCKS != nil {
+		if err := handler.SOCKSHandler(procCtx, cfg.SOCKS, s.Routes, filters); err != nil {
+			log.Panicf("Error SOCKS server: %v", err)
+		}
+		log.Printf("SOCKS5 proxy on %s", cfg.SOCKS.Listen)
+	}
+	if cfg.HTTPProxy != nil {
+		if err := handler.HTTPProxyHandler(procCtx, cfg.HTTPProxy, s.Routes, filters); err != nil {
+			log.Panicf("Error HTTP proxy: %v", err)
+		}
+		log.Printf("HTTP proxy on %s", cfg.HTTPProxy.Listen)
+	}
+	for _, f := range cfg.Forwards {
+		if f.Type != config.ForwardLocal {
+			continue
+		}
+		if err := handler.ForwardHandler(procCtx, f, filters); err != nil {
+			log.Panicf("Error local forward %s: %v", f.Listen, err)
+		}
+		log.Printf("Local forward %s -> %s through %s", f.Listen, f.Target, f.Agent)
+	}
+
+	go netstack.ForwardTunnelToEndpoint(procCtx, dev, linkEP, icmpHandler.HandlePacket)
 	go netstack.ForwardEndpointToTunnel(procCtx, linkEP, dev)
 
+	// SIGHUP reloads the routing table, the filter rules and the protocol
+	// rules from PROXY_CONFIG
+	reloadC := make(chan os.Signal, 1)
+	signal.Notify(reloadC, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-procCtx.Done():
+				return
+			case <-reloadC:
+				cfg, err := config.Load(os.Getenv("PROXY_CONFIG"))
+				if err != nil {
+					log.Printf("Got HUP, keeping routes and rules: %s", err)
+					continue
+				}
+				if err := routes.Reload(cfg); err != nil {
+					log.Printf("Got HUP, keeping routes: %s", err)
+				} else {
+					log.Printf("Got HUP, routes reloaded:\n%s", routes)
+				}
+				if rules, err := filter.Load(cfg.Rules); err != nil {
+					log.Printf("Got HUP, keeping rules: %s", err)
+				} else {
+					filters.Set(rules)
+					log.Printf("Got HUP, %d filter rules loaded", rules.Len())
+				}
+				if err := policy.Reload(cfg.Protocols); err != nil {
+					log.Printf("Got HUP, keeping protocol rules: %s", err)
+				} else {
+					log.Printf("Got HUP, %d protocol rules loaded", len(cfg.Protocols))
+				}
+			}
+		}
+	}()
+
 	statsC := make(chan os.Signal, 1)
 	signal.Notify(statsC, syscall.SIGUSR1)
 	go func() {
@@ -52,6 +185,8 @@ func main() {
 					stats.NICs.Rx.Bytes,
 					stats.NICs.Rx.Packets,
 				)
+				log.Printf("Routes:\n%s", routes)
+				log.Printf("Streams by protocol:\n%s", classify.Stats())
 			}
 
 		}
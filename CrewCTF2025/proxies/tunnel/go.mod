@@ -3,15 +3,16 @@ module github.com/tunneling
 go 1.24.5
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/shamaton/msgpack/v2 v2.2.3
+	golang.org/x/crypto v0.37.0
+	golang.org/x/net v0.39.0
 	golang.zx2c4.com/wireguard v0.0.0-20250521234502-f333402bd9cb
 	gvisor.dev/gvisor v0.0.0-20250723014020-312865986418
 )
 
 require (
 	github.com/google/btree v1.1.2 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
-	golang.org/x/net v0.39.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/time v0.7.0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
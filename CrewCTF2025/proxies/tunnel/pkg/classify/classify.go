@@ -0,0 +1,227 @@
+// Package classify tells which protocol a stream carries from the first
+// bytes its client sends.
+package classify
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// MAX_PREFIX is the most bytes Classify needs to decide, a TLS record with
+// the ClientHello.
+const MAX_PREFIX = 5 + 16384
+
+// Class is a protocol recognised by Classify.
+type Class string
+
+const (
+	Unknown    Class = "unknown"
+	HTTP1      Class = "http/1"
+	HTTP2      Class = "http/2"
+	TLS        Class = "tls"
+	SSH        Class = "ssh"
+	Redis      Class = "redis"
+	PostgreSQL Class = "postgresql"
+)
+
+// Classes lists every class, Unknown included.
+var Classes = []Class{Unknown, HTTP1, HTTP2, TLS, SSH, Redis, PostgreSQL}
+
+// HTTPMethods are the request methods an HTTP/1.x client starts with.
+var HTTPMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Result is the class of a stream. SNI and ALPN are what a TLS client asked
+// for in its ClientHello.
+type Result struct {
+	Class Class
+	SNI   string
+	ALPN  []string
+}
+
+// match is the outcome of one classifier on the data seen so far.
+type match int
+
+const (
+	no match = iota
+	yes
+	maybe
+)
+
+var classifiers = []struct {
+	class Class
+	match func(data []byte, r *Result) match
+}{
+	{HTTP1, matchHTTP1},
+	{HTTP2, matchHTTP2},
+	{TLS, matchTLS},
+	{SSH, matchSSH},
+	{Redis, matchRedis},
+	{PostgreSQL, matchPostgreSQL},
+}
+
+// Classify looks at the first bytes a client sent. more is true when they
+// are not enough to decide yet and could still match a class, the caller
+// should then try again with more bytes, up to MAX_PREFIX.
+func Classify(data []byte) (r Result, more bool) {
+	for _, c := range classifiers {
+		switch c.match(data, &r) {
+		case yes:
+			r.Class = c.class
+			return r, false
+		case maybe:
+			more = true
+		}
+	}
+	r.Class = Unknown
+	return r, more && len(data) < MAX_PREFIX
+}
+
+// prefix matches data against the start of a fixed string.
+func prefix(data []byte, s string) match {
+	switch {
+	case len(data) >= len(s) && string(data[:len(s)]) == s:
+		return yes
+	case len(data) < len(s) && string(data) == s[:len(data)]:
+		return maybe
+	}
+	return no
+}
+
+func matchHTTP1(data []byte, _ *Result) match {
+	m := no
+	for _, method := range HTTPMethods {
+		m = max(m, prefix(data, method+" "))
+		if m == yes {
+			return yes
+		}
+	}
+	return m
+}
+
+func matchHTTP2(data []byte, _ *Result) match {
+	return prefix(data, http2Preface)
+}
+
+func matchSSH(data []byte, _ *Result) match {
+	return prefix(data, "SSH-")
+}
+
+// matchRedis looks for a RESP array of bulk strings, as clients send their
+// commands: "*<n>\r\n$".
+func matchRedis(data []byte, _ *Result) match {
+	if len(data) == 0 {
+		return maybe
+	}
+	if data[0] != '*' {
+		return no
+	}
+	i := 1
+	for i < len(data) && data[i] >= '0' && data[i] <= '9' {
+		i++
+	}
+	if i == 1 && i < len(data) {
+		return no
+	}
+	return prefix(data[i:], "\r\n$")
+}
+
+// matchPostgreSQL looks for a startup, SSL, GSSAPI encryption or cancel
+// request.
+func matchPostgreSQL(data []byte, _ *Result) match {
+	if len(data) < 8 {
+		if len(data) == 0 || data[0] == 0 {
+			return maybe
+		}
+		return no
+	}
+	length := binary.BigEndian.Uint32(data)
+	code := binary.BigEndian.Uint32(data[4:])
+	switch {
+	case code == 196608 && length >= 8 && length <= 10000:
+	case (code == 80877103 || code == 80877104) && length == 8:
+	case code == 80877102 && length == 16:
+	default:
+		return no
+	}
+	return yes
+}
+
+// matchTLS looks for a handshake record with a ClientHello, and reads the
+// server name and ALPN protocols from it.
+func matchTLS(data []byte, r *Result) match {
+	if m := prefix(data, "\x16\x03"); m != yes {
+		return m
+	}
+	if len(data) < 5 {
+		return maybe
+	}
+	length := int(binary.BigEndian.Uint16(data[3:]))
+	if data[2] > 4 || length == 0 || length > MAX_PREFIX-5 {
+		return no
+	}
+	if len(data) < 5+length {
+		return maybe
+	}
+	record := cryptobyte.String(data[5 : 5+length])
+	var typ uint8
+	if !record.ReadUint8(&typ) || typ != 1 {
+		return no
+	}
+	// A ClientHello split over several records is still TLS, without
+	// the details
+	var hello cryptobyte.String
+	if record.ReadUint24LengthPrefixed(&hello) {
+		parseClientHello(hello, r)
+	}
+	return yes
+}
+
+func parseClientHello(hello cryptobyte.String, r *Result) {
+	var sessionID, ciphers, compression, extensions cryptobyte.String
+	if !hello.Skip(2+32) ||
+		!hello.ReadUint8LengthPrefixed(&sessionID) ||
+		!hello.ReadUint16LengthPrefixed(&ciphers) ||
+		!hello.ReadUint8LengthPrefixed(&compression) ||
+		!hello.ReadUint16LengthPrefixed(&extensions) {
+		return
+	}
+	for !extensions.Empty() {
+		var typ uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return
+		}
+		switch typ {
+		case 0: // server_name
+			var names cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&names) {
+				continue
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					break
+				}
+				if nameType == 0 {
+					r.SNI = string(name)
+				}
+			}
+		case 16: // application_layer_protocol_negotiation
+			var protos cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&protos) {
+				continue
+			}
+			for !protos.Empty() {
+				var proto cryptobyte.String
+				if !protos.ReadUint8LengthPrefixed(&proto) {
+					break
+				}
+				r.ALPN = append(r.ALPN, string(proto))
+			}
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package classify
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// clientHello returns the first record a crypto/tls client sends.
+func clientHello(t *testing.T, cfg *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// postgresMessage returns a length-prefixed message with code and body.
+func postgresMessage(code uint32, body string) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	b = binary.BigEndian.AppendUint32(b, code)
+	return append(b, body...)
+}
+
+// realInputs are what clients of each protocol send first.
+func realInputs(t *testing.T) []struct {
+	name string
+	data []byte
+	want Result
+} {
+	hello := clientHello(t, &tls.Config{ServerName: "example.org", NextProtos: []string{"h2", "http/1.1"}})
+	bare := clientHello(t, &tls.Config{InsecureSkipVerify: true})
+	return []struct {
+		name string
+		data []byte
+		want Result
+	}{
+		{"TLS with SNI and ALPN", hello, Result{Class: TLS, SNI: "example.org", ALPN: []string{"h2", "http/1.1"}}},
+		{"TLS without extensions of interest", bare, Result{Class: TLS}},
+		{"SSH banner", []byte("SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n"), Result{Class: SSH}},
+		{"RESP command", []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"), Result{Class: Redis}},
+		{"PostgreSQL startup", postgresMessage(196608, "user\x00postgres\x00database\x00app\x00\x00"), Result{Class: PostgreSQL}},
+		{"PostgreSQL SSLRequest", postgresMessage(80877103, ""), Result{Class: PostgreSQL}},
+		{"PostgreSQL GSSENCRequest", postgresMessage(80877104, ""), Result{Class: PostgreSQL}},
+		{"PostgreSQL CancelRequest", postgresMessage(80877102, "\x00\x00\x04\xd2\x12\x34\x56\x78"), Result{Class: PostgreSQL}},
+		{"HTTP/1.1 request", []byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n"), Result{Class: HTTP1}},
+		{"HTTP/2 preface", []byte(http2Preface + "\x00\x00\x00\x04\x00\x00\x00\x00\x00"), Result{Class: HTTP2}},
+		{"plain text", []byte("hello world\n"), Result{Class: Unknown}},
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for _, tt := range realInputs(t) {
+		t.Run(tt.name, func(t *testing.T) {
+			got, more := Classify(tt.data)
+			if more {
+				t.Error("got more, want a decision")
+			}
+			if got.Class != tt.want.Class || got.SNI != tt.want.SNI || !slices.Equal(got.ALPN, tt.want.ALPN) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Cut anywhere, an input is either classified already or needs more bytes,
+// never taken for something else.
+func TestClassifyTruncated(t *testing.T) {
+	for _, tt := range realInputs(t) {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range len(tt.data) {
+				got, more := Classify(tt.data[:i])
+				switch {
+				case more && got.Class != Unknown:
+					t.Fatalf("at %d: got %s with more", i, got.Class)
+				case !more && got.Class != tt.want.Class:
+					t.Fatalf("at %d: got %s, want %s or more", i, got.Class, tt.want.Class)
+				}
+			}
+			if _, more := Classify(nil); !more {
+				t.Error("nothing is enough to decide")
+			}
+		})
+	}
+}
+
+func TestMatchRedis(t *testing.T) {
+	tests := []struct {
+		data string
+		want match
+	}{
+		{"", maybe},
+		{"*", maybe},
+		{"*2", maybe},
+		{"*2\r", maybe},
+		{"*2\r\n", maybe},
+		{"*2\r\n$", yes},
+		{"*12\r\n$4\r\nPING\r\n", yes},
+		{"*\r\n$", no},
+		{"*x", no},
+		{"*2\n$", no},
+		{"*2\r\n:1", no},
+		{"+OK\r\n", no},
+		{"PING\r\n", no},
+	}
+	for _, tt := range tests {
+		if got := matchRedis([]byte(tt.data), nil); got != tt.want {
+			t.Errorf("matchRedis(%q) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPostgreSQL(t *testing.T) {
+	withLength := func(length, code uint32) []byte {
+		b := binary.BigEndian.AppendUint32(nil, length)
+		return binary.BigEndian.AppendUint32(b, code)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want match
+	}{
+		{"empty", nil, maybe},
+		{"length start", []byte{0, 0, 0}, maybe},
+		{"not a length", []byte{'G', 'E'}, no},
+		{"startup", postgresMessage(196608, "user\x00u\x00\x00"), yes},
+		{"startup header only", withLength(8, 196608), yes},
+		{"startup too long", withLength(10001, 196608), no},
+		{"startup too short", withLength(4, 196608), no},
+		{"old protocol", withLength(8, 131072), no},
+		{"SSLRequest", withLength(8, 80877103), yes},
+		{"SSLRequest bad length", withLength(12, 80877103), no},
+		{"GSSENCRequest", withLength(8, 80877104), yes},
+		{"CancelRequest", withLength(16, 80877102), yes},
+		{"CancelRequest bad length", withLength(8, 80877102), no},
+	}
+	for _, tt := range tests {
+		if got := matchPostgreSQL(tt.data, nil); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// helloBody builds a ClientHello body with the given extensions block, raw
+// so it can be malformed.
+func helloBody(extensions []byte) []byte {
+	b := make([]byte, 2+32)
+	b[0], b[1] = 3, 3
+	b = append(b, 0)                // session ID
+	b = append(b, 0, 2, 0x13, 0x01) // cipher suites
+	b = append(b, 1, 0)             // compression methods
+	return append(b, extensions...)
+}
+
+// record wraps a handshake message of type typ in a TLS record.
+func record(typ uint8, body []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(0x16)
+	b.AddUint16(0x0301)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(typ)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(body)
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+// extension returns an extension of type typ with a raw body.
+func extension(typ uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
+
+// extensions returns the extensions block holding exts.
+func extensions(exts ...[]byte) []byte {
+	var all []byte
+	for _, ext := range exts {
+		all = append(all, ext...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(all))), all...)
+}
+
+func TestMatchTLS(t *testing.T) {
+	sni := extension(0, []byte("\x00\x0e\x00\x00\x0bexample.org"))
+	alpn := extension(16, []byte("\x00\x0c\x02h2\x08http/1.1"))
+	tests := []struct {
+		name string
+		data []byte
+		want match
+		res  Result
+	}{
+		{"empty", nil, maybe, Result{}},
+		{"record type", []byte{0x16}, maybe, Result{}},
+		{"not handshake", []byte{0x17, 0x03, 0x03}, no, Result{}},
+		{"SSL 2", []byte{0x16, 0x02}, no, Result{}},
+		{"header cut", []byte{0x16, 0x03, 0x01, 0x00}, maybe, Result{}},
+		{"unknown version", []byte{0x16, 0x03, 0x05, 0x00, 0x10}, no, Result{}},
+		{"empty record", []byte{0x16, 0x03, 0x01, 0x00, 0x00}, no, Result{}},
+		{"record too long", []byte{0x16, 0x03, 0x01, 0x40, 0x01}, no, Result{}},
+		{"record cut", record(1, helloBody(extensions(sni)))[:20], maybe, Result{}},
+		{"server hello", record(2, helloBody(nil)), no, Result{}},
+		{"hello", record(1, helloBody(extensions(sni, alpn))), yes,
+			Result{SNI: "example.org", ALPN: []string{"h2", "http/1.1"}}},
+		{"hello split over records", []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x01, 0x00}, yes, Result{}},
+		{"record without message", []byte{0x16, 0x03, 0x01, 0x00, 0x01, 0x01}, yes, Result{}},
+		{"no extensions", record(1, helloBody(nil)), yes, Result{}},
+		{"random cut", record(1, make([]byte, 20)), yes, Result{}},
+		{"session ID cut", record(1, append(make([]byte, 34), 5, 1)), yes, Result{}},
+		{"extensions length", record(1, helloBody([]byte{0x00, 0x10, 0x00})), yes, Result{}},
+		{"extension cut", record(1, helloBody(extensions([]byte{0x00, 0x00, 0x00, 0x05}))), yes, Result{}},
+		{"extension after a bad one", record(1, helloBody(extensions(extension(0, []byte{0x00}), alpn))), yes,
+			Result{ALPN: []string{"h2", "http/1.1"}}},
+		{"server name cut", record(1, helloBody(extensions(extension(0, []byte("\x00\x0e\x00\x00\x0bexam"))))), yes, Result{}},
+		{"server name entry cut", record(1, helloBody(extensions(extension(0, []byte("\x00\x05\x00\x00\x0bexa")), alpn))), yes,
+			Result{ALPN: []string{"h2", "http/1.1"}}},
+		{"other name type", record(1, helloBody(extensions(extension(0, []byte("\x00\x0e\x01\x00\x0bexample.org"))))), yes, Result{}},
+		{"ALPN list cut", record(1, helloBody(extensions(extension(16, []byte("\x00\x0c\x02h2"))))), yes, Result{}},
+		{"ALPN protocol cut", record(1, helloBody(extensions(extension(16, []byte("\x00\x05\x02h2\x08ht"))))), yes,
+			Result{ALPN: []string{"h2"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Result
+			if m := matchTLS(tt.data, &got); m != tt.want {
+				t.Fatalf("got %d, want %d", m, tt.want)
+			}
+			if got.SNI != tt.res.SNI || !slices.Equal(got.ALPN, tt.res.ALPN) {
+				t.Errorf("got %+v, want %+v", got, tt.res)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package classify
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/tunneling/pkg/config"
+)
+
+// Policy limits the classes allowed on streams to some ports. It is safe for
+// concurrent use and can be reloaded while streams are checked.
+type Policy struct {
+	mu    sync.RWMutex
+	rules []policyRule
+}
+
+type policyRule struct {
+	prefix netip.Prefix
+	port   uint16
+	allow  []Class
+}
+
+// NewPolicy builds a policy from the configured protocol rules. Without any
+// rule every class is allowed everywhere.
+func NewPolicy(cfg []config.ProtocolPolicy) (*Policy, error) {
+	p := &Policy{}
+	if err := p.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload replaces the rules with the configured ones. The policy is left
+// untouched if the configuration is invalid.
+func (p *Policy) Reload(cfg []config.ProtocolPolicy) error {
+	rules := make([]policyRule, 0, len(cfg))
+	for _, entry := range cfg {
+		rule := policyRule{port: entry.Port}
+		if entry.CIDR != "" {
+			prefix, err := netip.ParsePrefix(entry.CIDR)
+			if err != nil {
+				return fmt.Errorf("bad protocol rule CIDR %q: %w", entry.CIDR, err)
+			}
+			rule.prefix = prefix.Masked()
+		}
+		if len(entry.Allow) == 0 {
+			return fmt.Errorf("protocol rule for port %d without allowed protocols", entry.Port)
+		}
+		for _, name := range entry.Allow {
+			if !slices.Contains(Classes, Class(name)) {
+				return fmt.Errorf("unknown protocol %q in rule for port %d", name, entry.Port)
+			}
+			rule.allow = append(rule.allow, Class(name))
+		}
+		rules = append(rules, rule)
+	}
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+	return nil
+}
+
+// Allowed tells whether a stream of class c may go to dst. Of the rules
+// covering dst, the one with the longest prefix applies, a rule for dst's
+// port before one for any port (0).
+func (p *Policy) Allowed(dst netip.AddrPort, c Class) bool {
+	addr := dst.Addr().Unmap()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var best *policyRule
+	for i := range p.rules {
+		r := &p.rules[i]
+		if r.port != 0 && r.port != dst.Port() {
+			continue
+		}
+		if r.prefix.IsValid() && !r.prefix.Contains(addr) {
+			continue
+		}
+		if best == nil || r.bits() > best.bits() || r.bits() == best.bits() && r.port > best.port {
+			best = r
+		}
+	}
+	return best == nil || slices.Contains(best.allow, c)
+}
+
+// bits is the length of the rule's prefix, -1 for any address.
+func (r *policyRule) bits() int {
+	if !r.prefix.IsValid() {
+		return -1
+	}
+	return r.prefix.Bits()
+}
@@ -0,0 +1,92 @@
+package classify
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/tunneling/pkg/config"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	p, err := NewPolicy([]config.ProtocolPolicy{
+		{Allow: []string{"tls", "http/1"}},
+		{CIDR: "10.0.0.0/8", Allow: []string{"ssh"}},
+		{CIDR: "10.0.0.0/8", Port: 443, Allow: []string{"tls"}},
+		{CIDR: "10.1.0.0/16", Allow: []string{"http/1"}},
+		{Port: 6379, Allow: []string{"redis"}},
+		{CIDR: "2001:db8::/32", Port: 5432, Allow: []string{"postgresql"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dst   string
+		class Class
+		want  bool
+	}{
+		// Only the rule for any address and port covers it
+		{"192.0.2.1:443", TLS, true},
+		{"192.0.2.1:443", SSH, false},
+		// A port rule beats port 0 at the same prefix length
+		{"192.0.2.1:6379", Redis, true},
+		{"192.0.2.1:6379", TLS, false},
+		{"10.2.0.1:443", TLS, true},
+		{"10.2.0.1:443", SSH, false},
+		{"10.2.0.1:22", SSH, true},
+		{"10.2.0.1:22", TLS, false},
+		// The longest prefix wins over a port rule
+		{"10.1.2.3:443", HTTP1, true},
+		{"10.1.2.3:443", TLS, false},
+		{"10.1.2.3:6379", Redis, false},
+		// Mapped IPv4 addresses are matched as IPv4
+		{"[::ffff:10.2.0.1]:22", SSH, true},
+		{"[2001:db8::1]:5432", PostgreSQL, true},
+		{"[2001:db8::1]:5432", TLS, false},
+		{"[2001:db8::1]:443", TLS, true},
+		{"[2001:db9::1]:5432", PostgreSQL, false},
+		{"[2001:db9::1]:443", Unknown, false},
+	}
+	for _, tt := range tests {
+		if got := p.Allowed(netip.MustParseAddrPort(tt.dst), tt.class); got != tt.want {
+			t.Errorf("Allowed(%s, %s) = %v, want %v", tt.dst, tt.class, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyEmpty(t *testing.T) {
+	p, err := NewPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range Classes {
+		if !p.Allowed(netip.MustParseAddrPort("192.0.2.1:1"), c) {
+			t.Errorf("%s not allowed without rules", c)
+		}
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	p, err := NewPolicy([]config.ProtocolPolicy{{Allow: []string{"ssh"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := netip.MustParseAddrPort("192.0.2.1:22")
+	for _, cfg := range [][]config.ProtocolPolicy{
+		{{CIDR: "10.0.0.0/33", Allow: []string{"tls"}}},
+		{{Port: 443}},
+		{{Port: 443, Allow: []string{"gopher"}}},
+	} {
+		if err := p.Reload(cfg); err == nil {
+			t.Errorf("Reload(%+v) succeeded, want an error", cfg)
+		}
+		if !p.Allowed(dst, SSH) || p.Allowed(dst, TLS) {
+			t.Fatalf("failed Reload(%+v) changed the rules", cfg)
+		}
+	}
+	if err := p.Reload([]config.ProtocolPolicy{{Allow: []string{"tls"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if p.Allowed(dst, SSH) || !p.Allowed(dst, TLS) {
+		t.Error("Reload did not replace the rules")
+	}
+}
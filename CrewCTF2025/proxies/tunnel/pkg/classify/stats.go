@@ -0,0 +1,54 @@
+package classify
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// count is the number of streams of a class.
+type count struct {
+	open  int
+	total int
+}
+
+var (
+	counts   = make(map[Class]*count)
+	countsMu sync.Mutex
+)
+
+// Track counts a stream of class c as open until done is called.
+func Track(c Class) (done func()) {
+	countsMu.Lock()
+	n, ok := counts[c]
+	if !ok {
+		n = &count{}
+		counts[c] = n
+	}
+	n.open++
+	n.total++
+	countsMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			countsMu.Lock()
+			n.open--
+			countsMu.Unlock()
+		})
+	}
+}
+
+// Stats returns the number of open and total streams of each class seen so
+// far.
+func Stats() string {
+	countsMu.Lock()
+	defer countsMu.Unlock()
+	var b strings.Builder
+	for _, c := range Classes {
+		if n, ok := counts[c]; ok {
+			fmt.Fprintf(&b, "\t%s: %d open, %d total\n", c, n.open, n.total)
+		}
+	}
+	return b.String()
+}
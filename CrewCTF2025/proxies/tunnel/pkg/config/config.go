@@ -1,8 +1,16 @@
 package config
 
+import "time"
+
 const (
 	MTU           = 1500
 	TUNName       = "tun0"
 	AgentName     = "haha"
 	LocalIPv4CIDR = "10.0.0.0/24"
+	LocalIPv6CIDR = "fd00::/64"
+	MaxFrameSize  = 256 * 1024
+
+	// SessionResumeTimeout is how long both ends keep the streams of an
+	// agent whose connection dropped, waiting for it to reconnect.
+	SessionResumeTimeout = 60 * time.Second
 )
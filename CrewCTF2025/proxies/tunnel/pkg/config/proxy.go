@@ -0,0 +1,231 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Proxy is the runtime configuration of cmd/proxy, read from the JSON file
+// named by PROXY_CONFIG. Every field is optional.
+type Proxy struct {
+	Destinations Destinations `json:"destinations"`
+
+	// Agents lists the agents allowed to attach. Without any entry only
+	// AgentName is accepted, with no credential.
+	Agents []AgentCredential `json:"agents"`
+	// DuplicateAgents decides what happens when an agent attaches under a
+	// name that is already connected: "replace" (the default) drops the old
+	// connection, "reject" refuses the new one and "keep" keeps both.
+	DuplicateAgents string `json:"duplicate_agents"`
+
+	// Routes picks the agent for each destination, the longest matching
+	// prefix wins. Without any entry everything goes to AgentName.
+	Routes []Route `json:"routes"`
+	// Groups lets a route be served by several agents.
+	Groups []AgentGroup `json:"groups"`
+
+	// TLS, when set, protects the agent link with mutual TLS. The subject
+	// common name of an agent's certificate is its name.
+	TLS *TLS `json:"tls"`
+	// Noise, when set, protects the agent link with a Noise IK handshake
+	// instead. Agents are known by their public key in Agents.
+	Noise *Noise `json:"noise"`
+
+	// Transports are the endpoints agents attach to, all served at once.
+	// Without any entry agents attach over TCP on 0.0.0.0:19001.
+	Transports []Transport `json:"transports"`
+
+	// SOCKS, when set, also serves a SOCKS5 proxy to reach the agents'
+	// networks without a TUN device.
+	SOCKS *SOCKS `json:"socks"`
+	// HTTPProxy, when set, also serves an HTTP proxy for CONNECT tunnels and
+	// absolute-URI requests.
+	HTTPProxy *HTTPProxy `json:"http_proxy"`
+
+	// Forwards are static TCP port forwards.
+	Forwards []Forward `json:"forwards"`
+
+	// Rules names the JSON file of content filter rules applied to the
+	// streams of TUN, SOCKS, HTTP proxy and local forward clients, see
+	// filter.Rules. Without it the built-in keyword redaction applies. The
+	// file is read again on SIGHUP.
+	Rules string `json:"rules"`
+
+	// Protocols restricts what TUN clients may run inside their streams,
+	// as told by the first bytes they send. The list is read again on
+	// SIGHUP.
+	Protocols []ProtocolPolicy `json:"protocols"`
+}
+
+// ProtocolPolicy resets the streams to Port (0 for any port), on any
+// destination or only those in CIDR, unless they carry one of the Allow
+// protocols: "http/1", "http/2", "tls", "ssh", "redis", "postgresql" or
+// "unknown".
+type ProtocolPolicy struct {
+	CIDR  string   `json:"cidr"`
+	Port  uint16   `json:"port"`
+	Allow []string `json:"allow"`
+}
+
+// Forward is a static TCP port forward ("host:port" addresses). A "local"
+// forward listens on Listen on the proxy and connects to Target through
+// Agent, a "remote" one has Agent listen on Listen and connects to Target
+// from the proxy.
+type Forward struct {
+	Type   string `json:"type"`
+	Agent  string `json:"agent"`
+	Listen string `json:"listen"`
+	Target string `json:"target"`
+}
+
+// SOCKS is the SOCKS5 frontend. Destinations are routed like TUN flows, host
+// names as 0.0.0.0, and reached as given: Destinations does not apply. With
+// Users set clients have to log in with one of them. UDP enables UDP
+// ASSOCIATE.
+type SOCKS struct {
+	Listen string      `json:"listen"`
+	Users  []ProxyUser `json:"users"`
+	UDP    bool        `json:"udp"`
+}
+
+// HTTPProxy is the HTTP proxy frontend, routed like SOCKS. With Users set
+// clients have to send Basic Proxy-Authorization for one of them, and
+// requests are logged under that name.
+type HTTPProxy struct {
+	Listen string      `json:"listen"`
+	Users  []ProxyUser `json:"users"`
+}
+
+// ProxyUser is a login of the SOCKS and HTTP proxy frontends.
+type ProxyUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Transport is an endpoint of the agent link. Type is "tcp" (the default) or
+// "websocket", served on Path ("/" when empty) over HTTP, or over HTTPS when
+// Cert and Key name a PEM certificate and key.
+type Transport struct {
+	Type   string `json:"type"`
+	Listen string `json:"listen"`
+	Path   string `json:"path"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+// Noise holds the proxy's static private key, in base64.
+type Noise struct {
+	PrivateKey string `json:"private_key"`
+}
+
+// TLS names the PEM files of the certificate and key to present and of the
+// CA that signed the peer's certificate.
+type TLS struct {
+	CA   string `json:"ca"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// Route sends flows towards CIDR through Agent, the name of an agent or of
+// an agent group. HTTPMode decides what happens to HTTP/1.x requests with
+// ambiguous framing on these flows: "lenient" (the default) rewrites them
+// into a canonical form, "strict" resets the stream.
+type Route struct {
+	CIDR     string `json:"cidr"`
+	Agent    string `json:"agent"`
+	HTTPMode string `json:"http_mode"`
+}
+
+// AgentGroup shares its routes between Agents. Policy picks the agent tried
+// first: "round-robin" (the default), "least-conn" or "failover", which
+// prefers agents in the listed order.
+type AgentGroup struct {
+	Name   string   `json:"name"`
+	Policy string   `json:"policy"`
+	Agents []string `json:"agents"`
+}
+
+// AgentCredential is the pre-shared token an agent has to present with its
+// name. An empty token means the agent is accepted without one. PublicKey is
+// the agent's Noise static key, in base64.
+type AgentCredential struct {
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	PublicKey string `json:"public_key"`
+}
+
+// Destinations controls where the agent connects for a flow the TUN client
+// opened towards a virtual address.
+type Destinations struct {
+	// Mode applies to addresses without an entry in Map: "loopback" (the
+	// default) connects to the agent's own loopback on the same port,
+	// "passthrough" connects to the original destination address.
+	Mode string               `json:"mode"`
+	Map  []DestinationMapping `json:"map"`
+}
+
+// DestinationMapping translates Virtual ("ip" or "ip:port") to Target
+// ("host", "host:port", "ip" or "ip:port") as seen from the agent. Without a
+// port in Target the original destination port is kept.
+type DestinationMapping struct {
+	Virtual string `json:"virtual"`
+	Target  string `json:"target"`
+}
+
+const (
+	DestinationLoopback    = "loopback"
+	DestinationPassthrough = "passthrough"
+
+	DuplicateReplace = "replace"
+	DuplicateReject  = "reject"
+	DuplicateKeep    = "keep"
+
+	PolicyRoundRobin = "round-robin"
+	PolicyLeastConn  = "least-conn"
+	PolicyFailover   = "failover"
+
+	TransportTCP       = "tcp"
+	TransportWebSocket = "websocket"
+
+	ForwardLocal  = "local"
+	ForwardRemote = "remote"
+
+	HTTPLenient = "lenient"
+	HTTPStrict  = "strict"
+)
+
+// Load reads the proxy configuration from path. An empty path gives the
+// defaults.
+func Load(path string) (*Proxy, error) {
+	cfg := &Proxy{
+		Destinations:    Destinations{Mode: DestinationLoopback},
+		DuplicateAgents: DuplicateReplace,
+		Transports:      defaultTransports(),
+	}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if cfg.Destinations.Mode == "" {
+		cfg.Destinations.Mode = DestinationLoopback
+	}
+	if cfg.DuplicateAgents == "" {
+		cfg.DuplicateAgents = DuplicateReplace
+	}
+	if len(cfg.Transports) == 0 {
+		cfg.Transports = defaultTransports()
+	}
+	return cfg, nil
+}
+
+func defaultTransports() []Transport {
+	return []Transport{{Type: TransportTCP, Listen: "0.0.0.0:19001"}}
+}
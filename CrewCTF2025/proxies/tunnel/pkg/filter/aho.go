@@ -0,0 +1,80 @@
+package filter
+
+// automaton is an Aho-Corasick automaton over the literal patterns of a
+// ruleset. Its state carries over from one chunk to the next, so a pattern
+// split across chunks still matches.
+type automaton struct {
+	nodes    []acNode
+	patterns [][]byte
+}
+
+type acNode struct {
+	next  map[byte]int32
+	fail  int32
+	depth int
+	// out lists the patterns ending at this node, including through
+	// failure links.
+	out []int
+}
+
+func newAutomaton(patterns [][]byte) *automaton {
+	a := &automaton{nodes: []acNode{{next: map[byte]int32{}}}, patterns: patterns}
+	for id, p := range patterns {
+		state := int32(0)
+		for _, c := range p {
+			next, ok := a.nodes[state].next[c]
+			if !ok {
+				next = int32(len(a.nodes))
+				a.nodes = append(a.nodes, acNode{next: map[byte]int32{}, depth: a.nodes[state].depth + 1})
+				a.nodes[state].next[c] = next
+			}
+			state = next
+		}
+		a.nodes[state].out = append(a.nodes[state].out, id)
+	}
+
+	// Failure links, breadth first so shallower nodes are done first
+	queue := make([]int32, 0, len(a.nodes))
+	for _, child := range a.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, child := range a.nodes[state].next {
+			fail := a.nodes[state].fail
+			for {
+				if next, ok := a.nodes[fail].next[c]; ok {
+					a.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = a.nodes[fail].fail
+			}
+			a.nodes[child].out = append(a.nodes[child].out, a.nodes[a.nodes[child].fail].out...)
+			queue = append(queue, child)
+		}
+	}
+	return a
+}
+
+// step moves from state over c.
+func (a *automaton) step(state int32, c byte) int32 {
+	for {
+		if next, ok := a.nodes[state].next[c]; ok {
+			return next
+		}
+		if state == 0 {
+			return 0
+		}
+		state = a.nodes[state].fail
+	}
+}
+
+// depth is how many of the last bytes seen in state are the start of a
+// pattern.
+func (a *automaton) depth(state int32) int {
+	return a.nodes[state].depth
+}
@@ -0,0 +1,331 @@
+// Package filter inspects and rewrites the data of tunnelled streams. Each
+// stream gets its own chain of filters, built when it opens, that sees the
+// data going both ways.
+package filter
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction is the way data flows through a stream.
+type Direction int
+
+const (
+	// ToAgent is data sent by the client, towards the target behind the
+	// agent.
+	ToAgent Direction = iota
+	// ToClient is data sent back by the target.
+	ToClient
+)
+
+func (d Direction) String() string {
+	if d == ToClient {
+		return "to_client"
+	}
+	return "to_agent"
+}
+
+// Verdict is what happens to a chunk of data once filtered.
+type Verdict int
+
+const (
+	Pass Verdict = iota
+	// Drop discards the chunk, the stream goes on.
+	Drop
+	// Reset aborts the stream.
+	Reset
+)
+
+// HOLD_TIMEOUT is how long a Conn holds back bytes that may start a match.
+const HOLD_TIMEOUT = 100 * time.Millisecond
+
+// MIN_READ_SIZE is the smallest read a Conn does on its connection.
+const MIN_READ_SIZE = 4096
+
+// ErrReset is returned by a Conn whose stream was aborted by a filter.
+var ErrReset = errors.New("stream reset by filter")
+
+// Filter inspects the data of one stream in both directions, chunk by
+// chunk, and keeps its state from one chunk to the next. It may rewrite a
+// chunk in place, without changing its length.
+type Filter interface {
+	// Filter inspects data going in direction dir. Its first seen bytes
+	// are the ones held back from the previous chunk, the filter saw them
+	// already but may still rewrite them.
+	Filter(dir Direction, data []byte, seen int) Verdict
+	// Hold returns how many bytes at the end of the last chunk could be
+	// the start of a match, and should not be passed on yet.
+	Hold(dir Direction) int
+}
+
+// Factory makes the filter of a new stream.
+type Factory interface {
+	NewFilter() Filter
+}
+
+// Chain runs filters in turn, until one drops the chunk or resets the stream.
+type Chain []Filter
+
+func (c Chain) Filter(dir Direction, data []byte, seen int) Verdict {
+	for _, f := range c {
+		if v := f.Filter(dir, data, seen); v != Pass {
+			return v
+		}
+	}
+	return Pass
+}
+
+func (c Chain) Hold(dir Direction) int {
+	hold := 0
+	for _, f := range c {
+		hold = max(hold, f.Hold(dir))
+	}
+	return hold
+}
+
+// Pipeline builds a Chain for each new stream from its factories. The
+// factories can be replaced at any time, streams keep the chain they
+// started with.
+type Pipeline struct {
+	mu        sync.RWMutex
+	factories []Factory
+}
+
+func NewPipeline(factories ...Factory) *Pipeline {
+	return &Pipeline{factories: factories}
+}
+
+// Set replaces the factories used for new streams.
+func (p *Pipeline) Set(factories ...Factory) {
+	p.mu.Lock()
+	p.factories = factories
+	p.mu.Unlock()
+}
+
+func (p *Pipeline) NewFilter() Filter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	chain := make(Chain, 0, len(p.factories))
+	for _, factory := range p.factories {
+		chain = append(chain, factory.NewFilter())
+	}
+	return chain
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type lingerer interface {
+	SetLinger(sec int) error
+}
+
+// Conn runs a filter on the data read from and written to a connection.
+// What is read goes in direction in, what is written in the other one. A
+// reset closes the connection with an RST where possible.
+//
+// Bytes that may be the start of a match are held back until the next chunk
+// shows whether they are, or for HOLD_TIMEOUT at most so a quiet peer is not
+// kept waiting. Past that a match is still detected, but only its part not
+// passed on yet can be redacted.
+type Conn struct {
+	net.Conn
+	filter Filter
+	in     Direction
+
+	// Read side, used by a single reader: rheld is held back, rout is
+	// filtered and waiting to be read.
+	rheld []byte
+	rout  []byte
+	rbuf  []byte
+
+	// The read deadline of the connection is the earliest of the caller's
+	// and of the held bytes' release, zero when unset.
+	dmu       sync.Mutex
+	rdeadline time.Time
+	rrelease  time.Time
+
+	wmu    sync.Mutex
+	wheld  []byte
+	wtimer *time.Timer
+}
+
+func NewConn(conn net.Conn, filter Filter, in Direction) *Conn {
+	return &Conn{Conn: conn, filter: filter, in: in}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.rout) == 0 {
+		if c.rbuf == nil {
+			c.rbuf = make([]byte, max(len(b), MIN_READ_SIZE))
+		}
+		n, err := c.Conn.Read(c.rbuf)
+		if errors.Is(err, os.ErrDeadlineExceeded) && c.released() {
+			// Nothing more came in time, let the held bytes go
+			c.setRelease(time.Time{})
+			c.rout, c.rheld = c.rheld, nil
+			continue
+		}
+
+		seen := len(c.rheld)
+		data := append(c.rheld, c.rbuf[:n]...)
+		c.rheld = nil
+		if n > 0 {
+			switch c.filter.Filter(c.in, data, seen) {
+			case Reset:
+				c.reset()
+				return 0, ErrReset
+			case Drop:
+				data = nil
+			}
+		}
+		hold := 0
+		if err == nil {
+			hold = min(c.filter.Hold(c.in), len(data))
+		}
+		c.rout = data[:len(data)-hold]
+		if hold > 0 {
+			c.rheld = append([]byte(nil), data[len(data)-hold:]...)
+			c.setRelease(time.Now().Add(HOLD_TIMEOUT))
+		} else {
+			c.setRelease(time.Time{})
+		}
+		if len(c.rout) > 0 {
+			slog.Debug("Filtered", "dir", c.in, slog.String("data", string(c.rout)))
+		}
+		if err != nil && len(c.rout) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rout)
+	c.rout = c.rout[n:]
+	return n, nil
+}
+
+// released tells whether the read deadline that passed was the release of
+// the held bytes rather than the caller's.
+func (c *Conn) released() bool {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	if c.rrelease.IsZero() {
+		return false
+	}
+	return c.rdeadline.IsZero() || time.Now().Before(c.rdeadline)
+}
+
+// setRelease sets when the held bytes go without more data, zero when
+// nothing is held.
+func (c *Conn) setRelease(t time.Time) {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	if t.IsZero() && c.rrelease.IsZero() {
+		return
+	}
+	c.rrelease = t
+	c.applyReadDeadline()
+}
+
+// applyReadDeadline sets the earliest of the deadlines on the connection,
+// with dmu held.
+func (c *Conn) applyReadDeadline() error {
+	t := c.rdeadline
+	if !c.rrelease.IsZero() && (t.IsZero() || c.rrelease.Before(t)) {
+		t = c.rrelease
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the caller's read deadline, which holding bytes back
+// never extends.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.rdeadline = t
+	return c.applyReadDeadline()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	out := c.in ^ 1
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wtimer != nil {
+		c.wtimer.Stop()
+	}
+
+	seen := len(c.wheld)
+	data := append(c.wheld, b...)
+	c.wheld = nil
+	switch c.filter.Filter(out, data, seen) {
+	case Reset:
+		c.reset()
+		return 0, ErrReset
+	case Drop:
+		return len(b), nil
+	}
+	hold := min(c.filter.Hold(out), len(data))
+	if hold > 0 {
+		c.wheld = append([]byte(nil), data[len(data)-hold:]...)
+		c.wtimer = time.AfterFunc(HOLD_TIMEOUT, c.flush)
+	}
+	data = data[:len(data)-hold]
+	if len(data) == 0 {
+		return len(b), nil
+	}
+	slog.Debug("Filtered", "dir", out, slog.String("data", string(data)))
+	if _, err := c.Conn.Write(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flush writes the bytes held back, when no more data came to complete a
+// match.
+func (c *Conn) flush() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wtimer != nil {
+		c.wtimer.Stop()
+	}
+	if len(c.wheld) > 0 {
+		c.Conn.Write(c.wheld)
+		c.wheld = nil
+	}
+}
+
+func (c *Conn) reset() {
+	if l, ok := c.Conn.(lingerer); ok {
+		l.SetLinger(0)
+	}
+}
+
+func (c *Conn) CloseWrite() error {
+	c.flush()
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *Conn) Close() error {
+	c.flush()
+	return c.Conn.Close()
+}
+
+func (c *Conn) SetLinger(sec int) error {
+	if l, ok := c.Conn.(lingerer); ok {
+		return l.SetLinger(sec)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pipe returns a Conn filtering what is read from the other end of a pipe,
+// which gets the bytes written to it one per Read.
+func pipe(t *testing.T, rules ...Rule) (*Conn, net.Conn) {
+	t.Helper()
+	rs, err := Compile(Rules{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return NewConn(server, rs.NewFilter(), ToAgent), client
+}
+
+// writeBytes writes data one byte per Write, so each Read of the other end
+// gets a single byte.
+func writeBytes(t *testing.T, w net.Conn, data []byte) {
+	for i := range data {
+		if _, err := w.Write(data[i : i+1]); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestConnByteAtATime(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		in   string
+		want string
+	}{
+		{"literal redact", Rule{Literal: "password"}, "user password=x", "user REDACTED=x"},
+		{"literal drop", Rule{Literal: "password", Action: ActionDrop}, "a password b", "a  b"},
+		{"literal partial", Rule{Literal: "password"}, "pass passport", "pass passport"},
+		{"fold redact", Rule{Literal: "secret", IgnoreCase: true}, "a SeCrEt b", "a REDACT b"},
+		{"fold drop", Rule{Literal: "secret", IgnoreCase: true, Action: ActionDrop}, "a sECRET b", "a  b"},
+		{"hex redact", Rule{Hex: "deadbeef"}, "ab\xde\xad\xbe\xefcd", "abREDAcd"},
+		{"hex drop", Rule{Hex: "deadbeef", Action: ActionDrop}, "ab\xde\xad\xbe\xefcd", "abcd"},
+		{"regex redact", Rule{Regex: `token=[0-9]+;`}, "x token=1234; y", "x REDACTED    y"},
+		{"regex drop", Rule{Regex: `card=[0-9]{4}`, Action: ActionDrop}, "a card=1234 b", "a  b"},
+		{"regex fold redact", Rule{Regex: `bearer [a-z]+`, IgnoreCase: true}, "Auth: BEARER abc\n", "Auth: REDACTED  \n"},
+		{"regex fold drop", Rule{Regex: `bearer [a-z]+`, IgnoreCase: true, Action: ActionDrop}, "Auth: BEARER abc\n", "Auth: \n"},
+		{"regex no match", Rule{Regex: `token=[0-9]+;`}, "token=12a token", "token=12a token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := pipe(t, tt.rule)
+			go func() {
+				writeBytes(t, client, []byte(tt.in))
+				client.Close()
+			}()
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	conn, client := pipe(t, Rule{Regex: `kill [0-9]+`, Action: ActionReset})
+	go writeBytes(t, client, []byte("ok kill 9"))
+	got, err := io.ReadAll(conn)
+	if err != ErrReset {
+		t.Fatalf("got error %v, want %v", err, ErrReset)
+	}
+	if bytes.Contains(got, []byte("kill")) {
+		t.Errorf("got %q, want the match held back", got)
+	}
+}
+
+func TestConnHoldTimeout(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		first string
+		rest  string
+		want  string
+	}{
+		{"literal", Rule{Literal: "password"}, "a pass", "word", "a passREDA"},
+		{"fold", Rule{Literal: "password", IgnoreCase: true}, "a PASS", "WORD", "a PASSREDA"},
+		{"hex", Rule{Hex: "deadbeef"}, "a\xde\xad", "\xbe\xef", "a\xde\xadRE"},
+		{"regex", Rule{Regex: `token=[0-9]+;`}, "a token=12", "34;", "a token=12RED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := pipe(t, tt.rule)
+			go writeBytes(t, client, []byte(tt.first))
+
+			// The start of a match is held back, then released when
+			// nothing completes it in time
+			start := time.Now()
+			got := make([]byte, len(tt.first))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.first {
+				t.Fatalf("got %q, want %q", got, tt.first)
+			}
+			if d := time.Since(start); d < HOLD_TIMEOUT {
+				t.Errorf("released after %v, want at least %v", d, HOLD_TIMEOUT)
+			}
+
+			// What comes later is still redacted
+			go func() {
+				writeBytes(t, client, []byte(tt.rest))
+				client.Close()
+			}()
+			rest, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.first + string(rest); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Holding bytes back neither drops nor extends the caller's read deadline.
+func TestConnKeepsReadDeadline(t *testing.T) {
+	conn, client := pipe(t, Rule{Literal: "password"})
+	deadline := time.Now().Add(3 * HOLD_TIMEOUT)
+	conn.SetReadDeadline(deadline)
+	go writeBytes(t, client, []byte("a pass"))
+
+	got := make([]byte, 6)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "a pass" {
+		t.Fatalf("got %q, want %q", got, "a pass")
+	}
+	if _, err := conn.Read(got); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if late := time.Since(deadline); late > HOLD_TIMEOUT {
+		t.Errorf("deadline passed %v late", late)
+	}
+
+	// A deadline shorter than the hold still applies
+	conn.SetReadDeadline(time.Now().Add(HOLD_TIMEOUT / 4))
+	go writeBytes(t, client, []byte(" pass"))
+	start := time.Now()
+	for {
+		if _, err := conn.Read(got); err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if d := time.Since(start); d >= HOLD_TIMEOUT {
+		t.Errorf("deadline expired after %v, want before the hold of %v", d, HOLD_TIMEOUT)
+	}
+}
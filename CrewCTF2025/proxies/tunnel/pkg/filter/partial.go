@@ -0,0 +1,72 @@
+package filter
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"slices"
+)
+
+// partialRegexp compiles a regular expression that matches, at the end of
+// the input, the longest suffix that may be the start of a match of expr.
+// It errs on the side of matching more, e.g. it ignores anchors and word
+// boundaries.
+func partialRegexp(expr string) (*regexp.Regexp, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.Compile(concat(prefixes(re), &syntax.Regexp{Op: syntax.OpEndText}).String())
+}
+
+// prefixes returns an expression matching every prefix of what re matches.
+func prefixes(re *syntax.Regexp) *syntax.Regexp {
+	empty := &syntax.Regexp{Op: syntax.OpEmptyMatch}
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return re
+	case syntax.OpLiteral:
+		alt := []*syntax.Regexp{empty}
+		for i := 1; i <= len(re.Rune); i++ {
+			alt = append(alt, &syntax.Regexp{Op: syntax.OpLiteral, Flags: re.Flags, Rune: re.Rune[:i]})
+		}
+		return alternate(alt...)
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return alternate(empty, re)
+	case syntax.OpCapture, syntax.OpQuest:
+		return prefixes(re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus:
+		star := &syntax.Regexp{Op: syntax.OpStar, Flags: re.Flags, Sub: re.Sub[:1]}
+		return concat(star, prefixes(re.Sub[0]))
+	case syntax.OpRepeat:
+		if re.Max == 0 {
+			return empty
+		}
+		rep := &syntax.Regexp{Op: syntax.OpStar, Flags: re.Flags, Sub: re.Sub[:1]}
+		if re.Max > 0 {
+			rep = &syntax.Regexp{Op: syntax.OpRepeat, Flags: re.Flags, Sub: re.Sub[:1], Max: re.Max - 1}
+		}
+		return concat(rep, prefixes(re.Sub[0]))
+	case syntax.OpConcat:
+		alt := make([]*syntax.Regexp, 0, len(re.Sub))
+		for k, sub := range re.Sub {
+			alt = append(alt, concat(append(slices.Clone(re.Sub[:k]), prefixes(sub))...))
+		}
+		return alternate(alt...)
+	case syntax.OpAlternate:
+		alt := make([]*syntax.Regexp, 0, len(re.Sub))
+		for _, sub := range re.Sub {
+			alt = append(alt, prefixes(sub))
+		}
+		return alternate(alt...)
+	}
+	// The empty match and empty-width assertions
+	return empty
+}
+
+func concat(sub ...*syntax.Regexp) *syntax.Regexp {
+	return &syntax.Regexp{Op: syntax.OpConcat, Sub: sub}
+}
+
+func alternate(sub ...*syntax.Regexp) *syntax.Regexp {
+	return &syntax.Regexp{Op: syntax.OpAlternate, Sub: sub}
+}
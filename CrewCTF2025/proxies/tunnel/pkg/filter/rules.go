@@ -0,0 +1,333 @@
+package filter
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+)
+
+const (
+	ActionRedact = "redact"
+	ActionDrop   = "drop"
+	ActionReset  = "reset"
+	ActionLog    = "log"
+
+	DirectionToAgent  = "to_agent"
+	DirectionToClient = "to_client"
+	DirectionBoth     = "both"
+)
+
+// redaction overwrites matches, cut or padded with spaces to their length.
+var redaction = []byte("REDACTED")
+
+// Rules is the content of a rules file.
+type Rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule matches one of Literal, Regex or Hex (the bytes of a hex string) and
+// applies Action: "redact" (the default) overwrites the match, "drop"
+// discards the chunk holding it, "reset" aborts the stream and "log" only
+// reports it. Direction is "to_agent" (the default), "to_client" or "both".
+type Rule struct {
+	Name       string `json:"name"`
+	Literal    string `json:"literal"`
+	Regex      string `json:"regex"`
+	Hex        string `json:"hex"`
+	IgnoreCase bool   `json:"ignore_case"`
+	Action     string `json:"action"`
+	Direction  string `json:"direction"`
+}
+
+// DefaultRules are used without a rules file: the keywords the proxy has
+// always redacted from what clients send.
+var DefaultRules = Rules{Rules: []Rule{
+	{Name: "chunked", Literal: "chunked", IgnoreCase: true},
+	{Name: "json", Literal: "json", IgnoreCase: true},
+	{Name: "urlencoded", Literal: "urlencoded", IgnoreCase: true},
+	{Name: "flag", Literal: "give me flag!", IgnoreCase: true},
+}}
+
+// Load reads a rules file. An empty path gives DefaultRules.
+func Load(path string) (*Ruleset, error) {
+	if path == "" {
+		return Compile(DefaultRules)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules %s: %w", path, err)
+	}
+	return Compile(rules)
+}
+
+// REGEX_WINDOW is how many bytes before a chunk regular expressions look
+// back at, so their matches may span chunks up to that length.
+const REGEX_WINDOW = 1024
+
+// Ruleset is a compiled rules file, a Factory of stream filters.
+type Ruleset struct {
+	rules []*rule
+
+	// literals are the literal and hex patterns of each direction.
+	literals [2]literalSet
+	regexes  []*rule
+}
+
+// literalSet matches patterns with an automaton, the case folding ones with
+// their own. exactRules and foldRules give the rule of each pattern.
+type literalSet struct {
+	exact      *automaton
+	exactRules []*rule
+	fold       *automaton
+	foldRules  []*rule
+}
+
+type rule struct {
+	name     string
+	action   string
+	toAgent  bool
+	toClient bool
+
+	literal []byte
+	fold    bool
+	re      *regexp.Regexp
+	// partial matches the end of the input that may start a match of re.
+	partial *regexp.Regexp
+}
+
+func Compile(rules Rules) (*Ruleset, error) {
+	rs := &Ruleset{}
+	for i, r := range rules.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+		cr := &rule{name: name, action: r.Action, fold: r.IgnoreCase}
+		switch cr.action {
+		case "":
+			cr.action = ActionRedact
+		case ActionRedact, ActionDrop, ActionReset, ActionLog:
+		default:
+			return nil, fmt.Errorf("%s: unknown action %q", name, r.Action)
+		}
+		switch r.Direction {
+		case "", DirectionToAgent:
+			cr.toAgent = true
+		case DirectionToClient:
+			cr.toClient = true
+		case DirectionBoth:
+			cr.toAgent, cr.toClient = true, true
+		default:
+			return nil, fmt.Errorf("%s: unknown direction %q", name, r.Direction)
+		}
+
+		patterns := 0
+		if r.Literal != "" {
+			patterns++
+			cr.literal = []byte(r.Literal)
+		}
+		if r.Hex != "" {
+			patterns++
+			b, err := hex.DecodeString(r.Hex)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad hex pattern: %w", name, err)
+			}
+			cr.literal = b
+		}
+		if r.Regex != "" {
+			patterns++
+			expr := r.Regex
+			if r.IgnoreCase {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad regex: %w", name, err)
+			}
+			cr.re = re
+			if cr.partial, err = partialRegexp(expr); err != nil {
+				return nil, fmt.Errorf("%s: bad regex: %w", name, err)
+			}
+		}
+		if patterns != 1 {
+			return nil, fmt.Errorf("%s: needs exactly one of literal, regex or hex", name)
+		}
+		rs.rules = append(rs.rules, cr)
+	}
+
+	for _, r := range rs.rules {
+		if r.re != nil {
+			rs.regexes = append(rs.regexes, r)
+		}
+	}
+	for _, dir := range []Direction{ToAgent, ToClient} {
+		set := &rs.literals[dir]
+		var exact, fold [][]byte
+		for _, r := range rs.rules {
+			switch {
+			case r.re != nil || !r.applies(dir):
+			case r.fold:
+				fold = append(fold, lowerASCII(r.literal))
+				set.foldRules = append(set.foldRules, r)
+			default:
+				exact = append(exact, r.literal)
+				set.exactRules = append(set.exactRules, r)
+			}
+		}
+		set.exact = newAutomaton(exact)
+		set.fold = newAutomaton(fold)
+	}
+	return rs, nil
+}
+
+// Len returns the number of rules.
+func (rs *Ruleset) Len() int {
+	return len(rs.rules)
+}
+
+func (rs *Ruleset) NewFilter() Filter {
+	return &ruleFilter{rs: rs}
+}
+
+// ruleFilter applies a ruleset to one stream. Literal patterns are matched
+// with automata whose state carries over between chunks, regular
+// expressions over the chunk and the REGEX_WINDOW bytes before it.
+type ruleFilter struct {
+	rs   *Ruleset
+	dirs [2]dirState
+}
+
+type dirState struct {
+	exact, fold int32
+	// recent holds the last bytes seen, the held back ones at its end.
+	recent []byte
+	// regexHold is how many bytes at the end of recent may start a match.
+	regexHold int
+}
+
+func (f *ruleFilter) Filter(dir Direction, data []byte, seen int) Verdict {
+	st := &f.dirs[dir]
+	lits := &f.rs.literals[dir]
+	verdict := Pass
+	apply := func(r *rule, start, end int) bool {
+		switch r.action {
+		case ActionReset:
+			slog.Warn("Filter reset stream", "rule", r.name, "dir", dir)
+			verdict = Reset
+			return true
+		case ActionDrop:
+			slog.Warn("Filter dropped data", "rule", r.name, "dir", dir, "len", len(data))
+			verdict = Drop
+		case ActionLog:
+			slog.Info("Filter matched", "rule", r.name, "dir", dir)
+		case ActionRedact:
+			// What came before data was passed on already
+			redact(data[max(start, 0):end])
+		}
+		return false
+	}
+
+	var fresh []byte
+	if len(f.rs.regexes) > 0 {
+		// Regular expressions run on the bytes as they came, the held back
+		// ones may have been redacted already
+		if len(st.recent) < seen {
+			st.recent = append([]byte(nil), data[:seen]...)
+		}
+		fresh = append([]byte(nil), data[seen:]...)
+	}
+
+	for i := seen; i < len(data); i++ {
+		c := data[i]
+		st.exact = lits.exact.step(st.exact, c)
+		for _, id := range lits.exact.nodes[st.exact].out {
+			if apply(lits.exactRules[id], i+1-len(lits.exact.patterns[id]), i+1) {
+				return verdict
+			}
+		}
+		st.fold = lits.fold.step(st.fold, lowerByte(c))
+		for _, id := range lits.fold.nodes[st.fold].out {
+			if apply(lits.foldRules[id], i+1-len(lits.fold.patterns[id]), i+1) {
+				return verdict
+			}
+		}
+	}
+
+	if len(f.rs.regexes) > 0 {
+		// Look back at the bytes before the new ones, the held back ones at
+		// the end of recent
+		history := st.recent[max(len(st.recent)-REGEX_WINDOW-seen, 0):]
+		scan := append(append([]byte(nil), history...), fresh...)
+		// base is where data starts in scan
+		base := len(history) - seen
+		st.regexHold = 0
+		for _, r := range f.rs.regexes {
+			if !r.applies(dir) {
+				continue
+			}
+			for _, m := range r.re.FindAllIndex(scan, -1) {
+				// Matches ending before the new bytes were handled already
+				if m[1] <= m[0] || m[1] <= len(history) {
+					continue
+				}
+				if apply(r, m[0]-base, m[1]-base) {
+					return verdict
+				}
+			}
+			if loc := r.partial.FindIndex(scan); loc != nil {
+				st.regexHold = max(st.regexHold, min(len(scan)-loc[0], REGEX_WINDOW))
+			}
+		}
+		st.recent = scan[max(len(scan)-REGEX_WINDOW-len(data), 0):]
+	}
+
+	if verdict == Drop {
+		// Dropped data cannot complete a match later
+		st.exact, st.fold = 0, 0
+		st.regexHold = 0
+	}
+	return verdict
+}
+
+// Hold returns how many bytes at the end of what dir carried so far may be
+// the start of a pattern.
+func (f *ruleFilter) Hold(dir Direction) int {
+	st := &f.dirs[dir]
+	lits := &f.rs.literals[dir]
+	return max(lits.exact.depth(st.exact), lits.fold.depth(st.fold), st.regexHold)
+}
+
+func (r *rule) applies(dir Direction) bool {
+	return (dir == ToAgent && r.toAgent) || (dir == ToClient && r.toClient)
+}
+
+func redact(match []byte) {
+	n := copy(match, redaction)
+	for i := n; i < len(match); i++ {
+		match[i] = ' '
+	}
+}
+
+// lowerASCII lowercases ASCII letters only, so offsets in the result are
+// offsets in b.
+func lowerASCII(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		out[i] = lowerByte(c)
+	}
+	return out
+}
+
+func lowerByte(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// addLocalAddress assigns the destination the TUN client asked for to the NIC,
+// so the stack can answer from that address.
+func addLocalAddress(ustack *stack.Stack, nicID tcpip.NICID, addr tcpip.Address) {
+	proto := ipv4.ProtocolNumber
+	if addr.Len() == 16 {
+		proto = ipv6.ProtocolNumber
+	}
+	pa := tcpip.ProtocolAddress{
+		AddressWithPrefix: addr.WithPrefix(),
+		Protocol:          proto,
+	}
+
+	ustack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
+		PEB:        stack.CanBePrimaryEndpoint,
+		ConfigType: stack.AddressConfigStatic,
+	})
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/netip"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/listener"
+	"github.com/tunneling/pkg/mapping"
+	"github.com/tunneling/pkg/routing"
+)
+
+// agentsFor returns the live agents routed to dst, the one to use first at
+// the front.
+func agentsFor(routes *routing.Table, dst netip.Addr) []*listener.AgentConn {
+	names, ok := routes.Candidates(dst, agentLoad)
+	if !ok {
+		slog.Error("No route to", "dst", dst)
+		return nil
+	}
+	agents := make([]*listener.AgentConn, 0, len(names))
+	for _, name := range names {
+		if agent := listener.GetClient(name); agent != nil {
+			agents = append(agents, agent)
+		}
+	}
+	if len(agents) == 0 {
+		slog.Error("Client is down", "clients", names, "dst", dst)
+	}
+	return agents
+}
+
+// agentFor returns the agent to use for dst, nil if there is no route or no
+// agent of the route is up.
+func agentFor(routes *routing.Table, dst netip.Addr) *listener.AgentConn {
+	if agents := agentsFor(routes, dst); len(agents) > 0 {
+		return agents[0]
+	}
+	return nil
+}
+
+func agentLoad(name string) int {
+	if agent := listener.GetClient(name); agent != nil {
+		return agent.Load()
+	}
+	return 0
+}
+
+// hostTarget returns the address to route host on, 0.0.0.0 for a name, and
+// the agent's target for it, without the port. The proxy frontends send
+// names to the agent to resolve.
+func hostTarget(host string) (netip.Addr, mapping.Target) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		return addr, mapping.Target{IP: addr.AsSlice()}
+	}
+	return netip.IPv4Unspecified(), mapping.Target{Host: host}
+}
+
+// validUser checks a login of the proxy frontends.
+func validUser(users []config.ProxyUser, username, password string) bool {
+	ok := 0
+	for _, u := range users {
+		ok |= subtle.ConstantTimeCompare([]byte(username), []byte(u.Username)) &
+			subtle.ConstantTimeCompare([]byte(password), []byte(u.Password))
+	}
+	return ok == 1
+}
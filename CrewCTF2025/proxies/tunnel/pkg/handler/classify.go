@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tunneling/pkg/classify"
+	"github.com/tunneling/pkg/protocol"
+)
+
+// CLASSIFY_TIMEOUT is how long a client that started sending has to send
+// enough for its stream to be classified.
+const CLASSIFY_TIMEOUT = 2 * time.Second
+
+var errProtocolDenied = errors.New("protocol not allowed")
+
+// classifiedConn is a TUN client whose stream is classified from the first
+// bytes it sends, then checked against the protocol policy. Nothing is read
+// until the client sends, so protocols where the server speaks first are
+// classified on the client's first answer.
+type classifiedConn struct {
+	*clientConn
+	stream *protocol.Stream
+	dst    netip.AddrPort
+	policy *classify.Policy
+
+	// Read side, used by a single reader
+	classified bool
+	pending    []byte
+	err        error
+
+	mu     sync.Mutex
+	done   func()
+	closed bool
+}
+
+func newClassifiedConn(client *clientConn, stream *protocol.Stream, dst netip.AddrPort, policy *classify.Policy) *classifiedConn {
+	return &classifiedConn{clientConn: client, stream: stream, dst: dst, policy: policy}
+}
+
+func (c *classifiedConn) Read(b []byte) (int, error) {
+	if !c.classified {
+		if err := c.classify(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.clientConn.Read(b)
+}
+
+// classify reads until the stream can be classified, keeping what was read
+// for the next reads.
+func (c *classifiedConn) classify() error {
+	buf := make([]byte, classify.MAX_PREFIX)
+	n := 0
+	var res classify.Result
+	var err error
+	for {
+		var m int
+		m, err = c.clientConn.Read(buf[n:])
+		if n == 0 && m > 0 {
+			c.clientConn.SetReadDeadline(time.Now().Add(CLASSIFY_TIMEOUT))
+		}
+		n += m
+		var more bool
+		res, more = classify.Classify(buf[:n])
+		if err != nil || !more {
+			break
+		}
+	}
+	if n == 0 {
+		return err
+	}
+	c.clientConn.SetReadDeadline(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = nil
+	}
+	c.classified = true
+	c.pending = buf[:n]
+	c.err = err
+
+	c.stream.SetClass(string(res.Class))
+	c.mu.Lock()
+	if !c.closed {
+		c.done = classify.Track(res.Class)
+	}
+	c.mu.Unlock()
+	slog.Info("Stream classified", "ID", c.stream.ID, "dst", c.dst, "class", res.Class, "sni", res.SNI, "alpn", res.ALPN)
+
+	if !c.policy.Allowed(c.dst, res.Class) {
+		slog.Warn("Stream protocol not allowed, resetting", "ID", c.stream.ID, "dst", c.dst, "class", res.Class)
+		c.SetLinger(0)
+		return errProtocolDenied
+	}
+	return nil
+}
+
+func (c *classifiedConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	if c.done != nil {
+		c.done()
+	}
+	c.mu.Unlock()
+	return c.clientConn.Close()
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
+	"github.com/tunneling/pkg/listener"
+)
+
+// ForwardHandler serves the local forward f until procCtx is done: every
+// connection to f.Listen is carried to f.Target through f.Agent.
+func ForwardHandler(procCtx context.Context, f config.Forward, filters filter.Factory) error {
+	host, portStr, err := net.SplitHostPort(f.Target)
+	if err != nil {
+		return fmt.Errorf("bad forward target: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad forward target port %q", portStr)
+	}
+	_, target := hostTarget(host)
+	target.Port = uint16(port)
+
+	ln, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-procCtx.Done()
+		_ = ln.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("Forward accept failed", "listen", f.Listen, "err", err)
+				continue
+			}
+			go func(c *net.TCPConn) {
+				slog.Info("Local forward request:", slog.String("from", c.RemoteAddr().String()), slog.String("to", target.String()), slog.String("agent", f.Agent))
+				agent := listener.GetClient(f.Agent)
+				if agent == nil {
+					slog.Error("Client is down", "client", f.Agent)
+					c.Close()
+					return
+				}
+				stream, err := connect([]*listener.AgentConn{agent}, target)
+				if err != nil {
+					c.Close()
+					return
+				}
+				slog.Info("Got connection from agent", "ID", stream.ID)
+				handleClient(c, stream, filters, config.HTTPLenient)
+			}(conn.(*net.TCPConn))
+		}
+	}()
+	return nil
+}
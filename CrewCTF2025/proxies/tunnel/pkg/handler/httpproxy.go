@@ -0,0 +1,247 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
+	"github.com/tunneling/pkg/listener"
+	"github.com/tunneling/pkg/protocol"
+	"github.com/tunneling/pkg/routing"
+)
+
+const HTTP_PROXY_HEADER_TIMEOUT = 10 * time.Second
+
+var errNoAgent = errors.New("no agent for destination")
+
+// HTTPProxyHandler serves an HTTP proxy on cfg.Listen until procCtx is done.
+// CONNECT tunnels and absolute-URI requests go through the agent routed to
+// the target, like flows from the TUN device.
+func HTTPProxyHandler(procCtx context.Context, cfg *config.HTTPProxy, routes *routing.Table, filters filter.Factory) error {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	p := &httpProxy{cfg: cfg, routes: routes, filters: filters}
+	p.forward = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL = r.In.URL
+			r.Out.Host = r.In.Host
+		},
+		Transport: &http.Transport{
+			DialContext:           p.dial,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+		},
+		ErrorHandler: p.forwardError,
+	}
+	srv := &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: HTTP_PROXY_HEADER_TIMEOUT,
+	}
+
+	go func() {
+		<-procCtx.Done()
+		_ = srv.Close()
+	}()
+
+	go func() {
+		if err := srv.Serve(&proxyListener{Listener: ln, p: p}); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP proxy failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+type httpProxy struct {
+	cfg     *config.HTTPProxy
+	routes  *routing.Table
+	filters filter.Factory
+	forward *httputil.ReverseProxy
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(r)
+	if !ok {
+		slog.Warn("HTTP proxy authentication failed", "from", r.RemoteAddr, "user", user)
+		w.Header().Set("Proxy-Authenticate", `Basic realm="tunnel"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		slog.Info("HTTP proxy CONNECT", "user", user, "from", r.RemoteAddr, "to", r.Host)
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "only CONNECT and absolute http:// requests are proxied", http.StatusBadRequest)
+		return
+	}
+	slog.Info("HTTP proxy request", "user", user, "from", r.RemoteAddr, "method", r.Method, "url", r.URL.Redacted())
+	// The request was normalised and filtered by the client's httpConn
+	p.forward.ServeHTTP(w, r)
+}
+
+// authenticate returns the user named by Proxy-Authorization, "-" for
+// anonymous clients when no users are configured.
+func (p *httpProxy) authenticate(r *http.Request) (string, bool) {
+	if len(p.cfg.Users) == 0 {
+		return "-", true
+	}
+	// ProxyAuthorization is not parsed by net/http, borrow BasicAuth on a
+	// request carrying it as Authorization
+	auth := &http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	username, password, ok := auth.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	return username, validUser(p.cfg.Users, username, password)
+}
+
+// tunnel answers a CONNECT once the agent connected to the target and pipes
+// the client's connection over the stream.
+func (p *httpProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	stream, err := p.connect(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), connectStatus(err))
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		stream.Close()
+		http.Error(w, "cannot hijack connection", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		stream.Close()
+		slog.Error("Cannot hijack HTTP proxy connection", "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+	slog.Info("Got connection from agent", "ID", stream.ID)
+	client := conn.(*httpConn)
+	client.id = stream.ID
+	err = protocol.Pipe(&httpTunnelConn{httpConn: client, r: rw.Reader}, stream)
+	slog.Info("Client connection closed", "ID", stream.ID, "err", err)
+}
+
+// connect opens a stream to hostport through the agents routed to it.
+func (p *httpProxy) connect(hostport string) (*protocol.Stream, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	dst, target := hostTarget(host)
+	target.Port = uint16(port)
+	agents := agentsFor(p.routes, dst)
+	if len(agents) == 0 {
+		return nil, errNoAgent
+	}
+	return connect(agents, target)
+}
+
+// httpMode returns the HTTP mode of the route to hostport, whose port is
+// optional.
+func (p *httpProxy) httpMode(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+	dst, _ := hostTarget(host)
+	return p.routes.HTTPMode(dst)
+}
+
+// dial connects the forwarding transport to the target of an absolute-URI
+// request.
+func (p *httpProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	stream, err := p.connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Responses are filtered on their way to the client, by its httpConn
+	return &upstreamConn{Stream: stream, addr: proxyAddr(addr)}, nil
+}
+
+func (p *httpProxy) forwardError(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Error("HTTP proxy request failed", "url", r.URL.Redacted(), "err", err)
+	w.WriteHeader(connectStatus(err))
+}
+
+func connectStatus(err error) int {
+	if errors.Is(err, listener.ErrConnectTimeout) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// httpTunnelConn is the client side of a CONNECT tunnel. It reads what the
+// server buffered first.
+type httpTunnelConn struct {
+	*httpConn
+	r *bufio.Reader
+}
+
+func (c *httpTunnelConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// proxyListener accepts the connections of HTTP proxy clients as httpConns,
+// so requests are normalised and filtered before the server reads them.
+type proxyListener struct {
+	net.Listener
+	p *httpProxy
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newProxyConn(conn, l.p.filters, l.p.httpMode), nil
+}
+
+// upstreamConn is a stream carrying absolute-URI requests.
+type upstreamConn struct {
+	*protocol.Stream
+	addr net.Addr
+}
+
+func (c *upstreamConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *upstreamConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// proxyAddr is the target of an upstream connection, as the client gave it.
+type proxyAddr string
+
+func (a proxyAddr) Network() string {
+	return "tcp"
+}
+
+func (a proxyAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/tunneling/pkg/mapping"
+	"github.com/tunneling/pkg/routing"
+)
+
+const ECHO_TIMEOUT = 3 * time.Second
+
+// MAX_IN_FLIGHT_ECHOS bounds the echo requests waiting for the agent, further
+// ones are dropped like on a congested link.
+const MAX_IN_FLIGHT_ECHOS = 256
+
+const (
+	ipv4HeaderLen     = 20
+	ipv6HeaderLen     = 40
+	icmpHeaderLen     = 8
+	protocolICMPv4    = 1
+	protocolICMPv6    = 58
+	icmpv4EchoReply   = 0
+	icmpv4EchoRequest = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// ICMPHandler answers ICMP echo requests sent to tun0. Each request is relayed
+// to the agent, which pings the target, and a reply is written back to the
+// TUN device only if the target answered.
+type ICMPHandler struct {
+	routes *routing.Table
+	mapper *mapping.Mapper
+	reply  func(packet []byte) error
+	// inFlight holds a slot per echo request being relayed.
+	inFlight chan struct{}
+}
+
+func NewICMPHandler(routes *routing.Table, mapper *mapping.Mapper, reply func(packet []byte) error) *ICMPHandler {
+	return &ICMPHandler{
+		routes:   routes,
+		mapper:   mapper,
+		reply:    reply,
+		inFlight: make(chan struct{}, MAX_IN_FLIGHT_ECHOS),
+	}
+}
+
+// HandlePacket takes over echo requests read from the TUN device. It returns
+// false for any other packet, which then goes to the stack as usual.
+func (h *ICMPHandler) HandlePacket(packet []byte) bool {
+	src, dst, icmp, ok := parseEchoRequest(packet)
+	if !ok {
+		return false
+	}
+	select {
+	case h.inFlight <- struct{}{}:
+	default:
+		slog.Debug("Too many echo requests in flight, dropping", "to", dst)
+		return true
+	}
+	// The TUN read buffer is reused, keep our own copy of the message
+	request := bytes.Clone(icmp)
+	go func() {
+		defer func() { <-h.inFlight }()
+		h.echo(src, dst, request)
+	}()
+	return true
+}
+
+// parseEchoRequest returns addresses and ICMP message of an ICMPv4 or ICMPv6
+// echo request. IPv6 packets with extension headers are not recognised.
+func parseEchoRequest(packet []byte) (src, dst netip.Addr, icmp []byte, ok bool) {
+	if len(packet) == 0 {
+		return
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < ipv4HeaderLen {
+			return
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < ipv4HeaderLen || len(packet) < ihl+icmpHeaderLen || packet[9] != protocolICMPv4 {
+			return
+		}
+		if packet[ihl] != icmpv4EchoRequest || packet[ihl+1] != 0 {
+			return
+		}
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		return src, dst, packet[ihl:], true
+	case 6:
+		if len(packet) < ipv6HeaderLen+icmpHeaderLen || packet[6] != protocolICMPv6 {
+			return
+		}
+		if packet[ipv6HeaderLen] != icmpv6EchoRequest || packet[ipv6HeaderLen+1] != 0 {
+			return
+		}
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		return src, dst, packet[ipv6HeaderLen:], true
+	}
+	return
+}
+
+func (h *ICMPHandler) echo(src, dst netip.Addr, request []byte) {
+	agent := agentFor(h.routes, dst)
+	if agent == nil {
+		return
+	}
+
+	target := h.mapper.Resolve(netip.AddrPortFrom(dst, 0))
+	ok, err := agent.Echo(target.IP, target.Host, request[icmpHeaderLen:], ECHO_TIMEOUT)
+	if err != nil || !ok {
+		slog.Debug("No echo reply", "to", dst, "err", err)
+		return
+	}
+
+	if err := h.reply(buildEchoReply(dst, src, request)); err != nil {
+		slog.Error("Failed to write echo reply", "err", err)
+	}
+}
+
+// buildEchoReply turns an echo request into the IP packet answering it,
+// keeping identifier, sequence number and data.
+func buildEchoReply(src, dst netip.Addr, request []byte) []byte {
+	if src.Is4() {
+		packet := make([]byte, ipv4HeaderLen+len(request))
+
+		ip := packet[:ipv4HeaderLen]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(len(packet)))
+		ip[8] = 64
+		ip[9] = protocolICMPv4
+		src4, dst4 := src.As4(), dst.As4()
+		copy(ip[12:16], src4[:])
+		copy(ip[16:20], dst4[:])
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+
+		icmp := packet[ipv4HeaderLen:]
+		copy(icmp, request)
+		icmp[0] = icmpv4EchoReply
+		icmp[1] = 0
+		icmp[2], icmp[3] = 0, 0
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+		return packet
+	}
+
+	packet := make([]byte, ipv6HeaderLen+len(request))
+
+	ip := packet[:ipv6HeaderLen]
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(request)))
+	ip[6] = protocolICMPv6
+	ip[7] = 64
+	src16, dst16 := src.As16(), dst.As16()
+	copy(ip[8:24], src16[:])
+	copy(ip[24:40], dst16[:])
+
+	icmp := packet[ipv6HeaderLen:]
+	copy(icmp, request)
+	icmp[0] = icmpv6EchoReply
+	icmp[1] = 0
+	icmp[2], icmp[3] = 0, 0
+
+	// ICMPv6 checksums cover a pseudo-header of addresses, length and next
+	// header
+	pseudo := make([]byte, 0, 40+len(icmp))
+	pseudo = append(pseudo, src16[:]...)
+	pseudo = append(pseudo, dst16[:]...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(icmp)))
+	pseudo = append(pseudo, 0, 0, 0, protocolICMPv6)
+	pseudo = append(pseudo, icmp...)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(pseudo))
+	return packet
+}
+
+// checksum computes the internet checksum (RFC 1071) of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
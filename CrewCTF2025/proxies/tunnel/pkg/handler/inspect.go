@@ -0,0 +1,379 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/tunneling/pkg/classify"
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
+)
+
+// HTTP_MAX_HEADER is the largest request head accepted on a stream, and the
+// size of its read buffer.
+const HTTP_MAX_HEADER = 64 * 1024
+
+// HTTP_MAX_BODY is the largest request body accepted, before and after
+// decoding.
+const HTTP_MAX_BODY = 8 * 1024 * 1024
+
+var (
+	errHeaderTooLarge      = errors.New("request header too large")
+	errAmbiguous           = errors.New("ambiguous request framing")
+	errBodyTooLarge        = errors.New("request body too large")
+	errBadBody             = errors.New("malformed request body")
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errRejected            = errors.New("request rejected")
+)
+
+const (
+	httpDetect = iota
+	httpRequests
+	httpRaw
+)
+
+// Decisions taken on a request, as written to the audit log.
+const (
+	auditPass      = "pass"
+	auditNormalize = "normalize"
+	auditReject    = "reject"
+	auditReset     = "reset"
+)
+
+// httpConn is the client side of a stream. When the client speaks HTTP/1.x,
+// each request is parsed, its body de-chunked and decoded, and the filter
+// rules run on the head and on the decoded body before the request is passed
+// on in a plain form. Anything else, and what follows a CONNECT or an
+// Upgrade, goes through the stream's filter as raw bytes, like responses.
+// Heads and bodies go through that filter too, so matches spanning them, or
+// consecutive requests, are caught.
+//
+// Requests with ambiguous framing are rewritten with a single Content-Length
+// in config.HTTPLenient mode, and reset the stream in config.HTTPStrict
+// mode. Every decision goes to the audit log.
+type httpConn struct {
+	*filter.Conn
+	id       uint32
+	filter   filter.Filter
+	httpMode string
+	// modeFor, on connections of HTTP proxy clients, gives the mode of
+	// each request from its target.
+	modeFor func(hostport string) string
+	r       *bufio.Reader
+	mode    int
+	out     []byte
+}
+
+func newHTTPConn(client net.Conn, id uint32, filters filter.Factory, httpMode string) *httpConn {
+	r := bufio.NewReaderSize(client, HTTP_MAX_HEADER)
+	f := filters.NewFilter()
+	return &httpConn{
+		Conn:     filter.NewConn(&bufferedConn{Conn: client, r: r}, f, filter.ToAgent),
+		id:       id,
+		filter:   f,
+		httpMode: httpMode,
+		r:        r,
+	}
+}
+
+// newProxyConn returns the connection of an HTTP proxy client, whose
+// requests are inspected before the proxy reads them.
+func newProxyConn(client net.Conn, filters filter.Factory, modeFor func(hostport string) string) *httpConn {
+	c := newHTTPConn(client, 0, filters, config.HTTPLenient)
+	c.modeFor = modeFor
+	c.mode = httpRequests
+	return c
+}
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	for len(c.out) == 0 {
+		switch c.mode {
+		case httpDetect:
+			ok, err := looksLikeHTTP(c.r)
+			if err != nil {
+				return 0, err
+			}
+			c.mode = httpRaw
+			if ok {
+				c.mode = httpRequests
+			}
+		case httpRequests:
+			if err := c.nextRequest(); err != nil {
+				if c.modeFor != nil && !connError(err) {
+					// The client was answered, the proxy must not answer again
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+		default:
+			return c.Conn.Read(b)
+		}
+	}
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// nextRequest reads, inspects and queues the next request of the client.
+func (c *httpConn) nextRequest() error {
+	head, err := peekHead(c.r)
+	switch {
+	case err == io.EOF, connError(err):
+		return err
+	case errors.Is(err, errHeaderTooLarge):
+		return c.reject(nil, http.StatusRequestHeaderFieldsTooLarge, nil, err)
+	case err != nil:
+		return c.reject(nil, http.StatusBadRequest, nil, err)
+	}
+	anomalies := framingAnomalies(head)
+	req, err := http.ReadRequest(c.r)
+	if err != nil {
+		return c.reject(nil, http.StatusBadRequest, anomalies, err)
+	}
+	if c.modeFor != nil {
+		c.httpMode = c.modeFor(req.Host)
+	}
+	if len(anomalies) > 0 && c.httpMode == config.HTTPStrict {
+		c.audit(req, auditReset, anomalies, errAmbiguous)
+		c.Conn.SetLinger(0)
+		return errAmbiguous
+	}
+
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		// The body is read before anything reaches the server, answer for it
+		req.Header.Del("Expect")
+		if _, err := c.Conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n")); err != nil {
+			return err
+		}
+	}
+	framed := req.Header.Get("Content-Length") != "" || len(req.TransferEncoding) > 0
+	body, err := readBody(req)
+	if connError(err) {
+		return err
+	}
+	if err != nil {
+		return c.reject(req, bodyStatus(err), anomalies, err)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s %s %s\r\n", req.Method, req.RequestURI, req.Proto)
+	if req.Host != "" {
+		fmt.Fprintf(&out, "Host: %s\r\n", req.Host)
+	}
+	req.Header.Write(&out)
+	if framed || len(body) > 0 {
+		fmt.Fprintf(&out, "Content-Length: %d\r\n", len(body))
+	}
+	out.WriteString("\r\n")
+
+	// Head and body are filtered as one chunk, so a match may span them.
+	// The request is complete, what the filter would hold back goes on
+	// with it: a match carrying on in the next request is still caught, as
+	// after HOLD_TIMEOUT on a Conn.
+	headLen := out.Len()
+	data := append(out.Bytes(), body...)
+	switch c.filter.Filter(filter.ToAgent, data, 0) {
+	case filter.Reset:
+		c.audit(req, auditReset, anomalies, filter.ErrReset)
+		c.Conn.SetLinger(0)
+		return filter.ErrReset
+	case filter.Drop:
+		return c.reject(req, http.StatusForbidden, anomalies, errRejected)
+	}
+	slog.Debug("Filtered HTTP request", "ID", c.id, slog.String("head", string(data[:headLen])), "body", len(body))
+	if len(anomalies) > 0 {
+		c.audit(req, auditNormalize, anomalies, nil)
+	} else {
+		c.audit(req, auditPass, nil, nil)
+	}
+
+	c.out = data
+	switch {
+	case req.Method == http.MethodConnect && c.modeFor != nil:
+		// What follows goes through the proxy's tunnel, and is inspected
+		// like a TUN client's along the mode of its target
+		c.modeFor = nil
+		c.mode = httpDetect
+	case req.Method == http.MethodConnect, req.Header.Get("Upgrade") != "":
+		c.mode = httpRaw
+	}
+	return nil
+}
+
+// reject answers the client with status instead of passing its request on,
+// and fails the stream.
+func (c *httpConn) reject(req *http.Request, status int, anomalies []string, err error) error {
+	c.audit(req, auditReject, anomalies, err, "status", status)
+	fmt.Fprintf(c.Conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+	return fmt.Errorf("%w: %w", errRejected, err)
+}
+
+// audit logs the decision taken on a request, req is nil when it could not
+// be parsed.
+func (c *httpConn) audit(req *http.Request, action string, anomalies []string, err error, args ...any) {
+	args = append(args, "ID", c.id, "from", c.RemoteAddr(), "mode", c.httpMode, "action", action)
+	if req != nil {
+		args = append(args, "method", req.Method, "host", req.Host, "uri", req.RequestURI)
+	}
+	if len(anomalies) > 0 {
+		args = append(args, "anomalies", strings.Join(anomalies, ", "))
+	}
+	if err != nil {
+		args = append(args, "err", err)
+	}
+	level := slog.LevelInfo
+	if action != auditPass {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "HTTP audit", args...)
+}
+
+// looksLikeHTTP tells whether r starts with an HTTP method and a space.
+func looksLikeHTTP(r *bufio.Reader) (bool, error) {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			if len(b) == 0 {
+				return false, err
+			}
+			return false, nil
+		}
+		prefix := false
+		for _, m := range classify.HTTPMethods {
+			if len(b) == len(m)+1 && string(b) == m+" " {
+				return true, nil
+			}
+			if len(b) <= len(m) && strings.HasPrefix(m, string(b)) {
+				prefix = true
+			}
+		}
+		if !prefix {
+			return false, nil
+		}
+	}
+}
+
+// readBody reads the body of req, de-chunked by net/http, and decodes it
+// along its Content-Encoding. req is updated to carry the decoded body.
+func readBody(req *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, HTTP_MAX_BODY+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadBody, err)
+	}
+	if len(body) > HTTP_MAX_BODY {
+		return nil, errBodyTooLarge
+	}
+
+	var codings []string
+	for _, v := range req.Header.Values("Content-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	// Codings are listed in the order they were applied
+	for i := len(codings) - 1; i >= 0; i-- {
+		if body, err = decode(codings[i], body); err != nil {
+			return nil, err
+		}
+	}
+
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	// Left in place by net/http for HTTP/1.0, which it reads without
+	req.Header.Del("Transfer-Encoding")
+	req.TransferEncoding = nil
+	req.ContentLength = int64(len(body))
+	req.Body = http.NoBody
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return body, nil
+}
+
+func decode(coding string, body []byte) ([]byte, error) {
+	var r io.Reader
+	switch coding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadBody, err)
+		}
+		r = zr
+	case "deflate":
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			// Some clients send raw deflate without the zlib wrapper
+			zr = flate.NewReader(bytes.NewReader(body))
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, coding)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, HTTP_MAX_BODY+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errBadBody, coding, err)
+	}
+	if len(out) > HTTP_MAX_BODY {
+		return nil, errBodyTooLarge
+	}
+	return out, nil
+}
+
+// connError tells whether err comes from the connection rather than from
+// what the client sent.
+func connError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, net.ErrClosed)
+}
+
+func bodyStatus(err error) int {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+// bufferedConn reads a connection through r, which may hold bytes of it
+// already.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *bufferedConn) SetLinger(sec int) error {
+	if l, ok := c.Conn.(interface{ SetLinger(sec int) error }); ok {
+		return l.SetLinger(sec)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
+)
+
+// inspect returns what an httpConn filtered with rules passes on for input.
+func inspect(t *testing.T, rules filter.Rules, input string) string {
+	t.Helper()
+	rs, err := filter.Compile(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte(input))
+		client.Close()
+	}()
+	c := newHTTPConn(server, 1, filter.NewPipeline(rs), config.HTTPLenient)
+	out, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestRequestFiltered(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules filter.Rules
+		input string
+		want  string
+	}{
+		{
+			"match spanning head and body",
+			filter.Rules{Rules: []filter.Rule{{Regex: `Length: 9\r\n\r\nsecret`}}},
+			"POST / HTTP/1.1\r\nHost: example.org\r\nContent-Length: 9\r\n\r\nsecret=42",
+			"POST / HTTP/1.1\r\nHost: example.org\r\nContent-REDACTED           =42",
+		},
+		{
+			"match at the end of the body",
+			filter.DefaultRules,
+			"POST / HTTP/1.1\r\nHost: example.org\r\nContent-Length: 13\r\n\r\ngive me flag!",
+			"POST / HTTP/1.1\r\nHost: example.org\r\nContent-Length: 13\r\n\r\nREDACTED     ",
+		},
+		{
+			"match at the end of a chunked body",
+			filter.DefaultRules,
+			"POST / HTTP/1.1\r\nHost: example.org\r\nTransfer-Encoding: Chunked\r\n\r\n7\r\ngive me\r\n6\r\n flag!\r\n0\r\n\r\n",
+			"POST / HTTP/1.1\r\nHost: example.org\r\nContent-Length: 13\r\n\r\nREDACTED     ",
+		},
+		{
+			"match spanning requests",
+			filter.Rules{Rules: []filter.Rule{{Literal: "\r\n\r\nGET /admin"}}},
+			"GET / HTTP/1.1\r\nHost: example.org\r\n\r\nGET /admin HTTP/1.1\r\nHost: example.org\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: example.org\r\n\r\nREDACTED   HTTP/1.1\r\nHost: example.org\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inspect(t, tt.rules, tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+)
+
+// peekHead returns the head of the next request, up to and with its empty
+// line, without consuming it.
+func peekHead(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, _ := r.Peek(r.Buffered())
+		if end := headEnd(b); end > 0 {
+			return bytes.Clone(b[:end]), nil
+		}
+		if len(b) >= HTTP_MAX_HEADER {
+			return nil, errHeaderTooLarge
+		}
+		if _, err := r.Peek(len(b) + 1); err != nil {
+			if err == io.EOF && len(b) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// headEnd returns the length of the head in b, up to the first empty line
+// ended by CRLF or a bare LF, or -1.
+func headEnd(b []byte) int {
+	for i, c := range b {
+		if c != '\n' {
+			continue
+		}
+		rest := b[i+1:]
+		if bytes.HasPrefix(rest, []byte("\n")) {
+			return i + 2
+		}
+		if bytes.HasPrefix(rest, []byte("\r\n")) {
+			return i + 3
+		}
+	}
+	return -1
+}
+
+// framingAnomalies lists what, in a raw request head, servers may read
+// differently from net/http: line endings, folded or malformed header lines,
+// and conflicting Content-Length and Transfer-Encoding headers.
+func framingAnomalies(head []byte) []string {
+	var found []string
+	add := func(anomaly string) {
+		if !slices.Contains(found, anomaly) {
+			found = append(found, anomaly)
+		}
+	}
+
+	var lengths, encodings []string
+	lines := bytes.SplitAfter(head, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if !bytes.HasSuffix(line, []byte("\r\n")) {
+			add("bare LF")
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if bytes.IndexByte(line, '\r') >= 0 {
+			add("bare CR")
+		}
+		if i == 0 || len(line) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			add("obs-fold")
+			continue
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			add("header without colon")
+			continue
+		}
+		if len(bytes.TrimRight(name, " \t")) != len(name) {
+			add("whitespace before colon")
+		}
+		switch strings.ToLower(strings.TrimSpace(string(name))) {
+		case "content-length":
+			lengths = append(lengths, strings.TrimSpace(string(value)))
+		case "transfer-encoding":
+			encodings = append(encodings, strings.TrimSpace(string(value)))
+		}
+	}
+
+	if len(lengths) > 1 {
+		add("duplicate Content-Length")
+	}
+	for _, l := range lengths {
+		if l == "" || strings.Trim(l, "0123456789") != "" {
+			add("bad Content-Length")
+		}
+	}
+	if len(encodings) > 0 {
+		if len(lengths) > 0 {
+			add("Content-Length with Transfer-Encoding")
+		}
+		if len(encodings) > 1 || !strings.EqualFold(encodings[0], "chunked") {
+			add("Transfer-Encoding other than chunked")
+		}
+		if bytes.HasSuffix(bytes.TrimRight(lines[0], "\r\n"), []byte(" HTTP/1.0")) {
+			add("Transfer-Encoding in HTTP/1.0")
+		}
+	}
+	return found
+}
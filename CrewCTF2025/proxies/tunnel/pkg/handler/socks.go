@@ -0,0 +1,410 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
+	"github.com/tunneling/pkg/listener"
+	"github.com/tunneling/pkg/mapping"
+	"github.com/tunneling/pkg/routing"
+)
+
+const SOCKS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// SOCKS5 constants, RFC 1928 and RFC 1929.
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthRejected = 0xff
+
+	socksPasswordVersion = 1
+
+	socksConnect      = 0x01
+	socksUDPAssociate = 0x03
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksNetworkUnreachable = 0x03
+	socksHostUnreachable    = 0x04
+	socksConnectionRefused  = 0x05
+	socksCommandUnsupported = 0x07
+	socksAddressUnsupported = 0x08
+)
+
+var (
+	errSOCKSVersion = errors.New("not a SOCKS5 client")
+	errSOCKSAuth    = errors.New("SOCKS authentication failed")
+	errSOCKSAddress = errors.New("unsupported SOCKS address type")
+)
+
+// SOCKSHandler serves SOCKS5 on cfg.Listen until procCtx is done. Streams go
+// through the agent routed to the destination, like flows from the TUN
+// device.
+func SOCKSHandler(procCtx context.Context, cfg *config.SOCKS, routes *routing.Table, filters filter.Factory) error {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	s := &socksServer{cfg: cfg, routes: routes, filters: filters}
+
+	go func() {
+		<-procCtx.Done()
+		_ = ln.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("SOCKS accept failed", "err", err)
+				continue
+			}
+			go s.serve(conn.(*net.TCPConn))
+		}
+	}()
+	return nil
+}
+
+type socksServer struct {
+	cfg     *config.SOCKS
+	routes  *routing.Table
+	filters filter.Factory
+}
+
+func (s *socksServer) serve(conn *net.TCPConn) {
+	conn.SetDeadline(time.Now().Add(SOCKS_HANDSHAKE_TIMEOUT))
+	if err := s.authenticate(conn); err != nil {
+		slog.Error("SOCKS handshake failed", "from", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil || req[0] != socksVersion {
+		slog.Error("Bad SOCKS request", "from", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	dst, target, err := readSOCKSAddr(conn, req[3])
+	if err != nil {
+		slog.Error("Bad SOCKS request", "from", conn.RemoteAddr(), "err", err)
+		if errors.Is(err, errSOCKSAddress) {
+			writeSOCKSReply(conn, socksAddressUnsupported, netip.AddrPort{})
+		}
+		conn.Close()
+		return
+	}
+
+	switch req[1] {
+	case socksConnect:
+		s.connect(conn, dst, target)
+	case socksUDPAssociate:
+		if !s.cfg.UDP {
+			writeSOCKSReply(conn, socksCommandUnsupported, netip.AddrPort{})
+			conn.Close()
+			return
+		}
+		s.associate(conn)
+	default:
+		writeSOCKSReply(conn, socksCommandUnsupported, netip.AddrPort{})
+		conn.Close()
+	}
+}
+
+// authenticate negotiates the method, username/password when users are
+// configured and none otherwise.
+func (s *socksServer) authenticate(conn net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return errSOCKSVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	want := byte(socksAuthNone)
+	if len(s.cfg.Users) > 0 {
+		want = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksAuthRejected})
+		return fmt.Errorf("%w: no acceptable method", errSOCKSAuth)
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return err
+	}
+	if want == socksAuthNone {
+		return nil
+	}
+
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksPasswordVersion {
+		return fmt.Errorf("%w: bad subnegotiation version %d", errSOCKSAuth, hdr[0])
+	}
+	username := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return err
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	if !validUser(s.cfg.Users, string(username), string(password)) {
+		conn.Write([]byte{socksPasswordVersion, 1})
+		return fmt.Errorf("%w: user %q", errSOCKSAuth, username)
+	}
+	_, err := conn.Write([]byte{socksPasswordVersion, 0})
+	return err
+}
+
+func (s *socksServer) connect(conn *net.TCPConn, dst netip.Addr, target mapping.Target) {
+	slog.Info("SOCKS connect request:", slog.String("from", conn.RemoteAddr().String()), slog.String("to", target.String()))
+	agents := agentsFor(s.routes, dst)
+	if len(agents) == 0 {
+		writeSOCKSReply(conn, socksNetworkUnreachable, netip.AddrPort{})
+		conn.Close()
+		return
+	}
+	stream, err := connect(agents, target)
+	if err != nil {
+		rep := byte(socksHostUnreachable)
+		if errors.Is(err, listener.ErrConnectRefused) {
+			rep = socksConnectionRefused
+		}
+		writeSOCKSReply(conn, rep, netip.AddrPort{})
+		conn.Close()
+		return
+	}
+	// The agent's end of the connection is not known here
+	if err := writeSOCKSReply(conn, socksSucceeded, netip.AddrPort{}); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("Got connection from agent", "ID", stream.ID)
+	handleClient(conn, stream, s.filters, s.routes.HTTPMode(dst))
+}
+
+// associate relays the client's UDP datagrams until it closes the control
+// connection.
+func (s *socksServer) associate(conn *net.TCPConn) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		slog.Error("Cannot open SOCKS UDP relay", "err", err)
+		writeSOCKSReply(conn, socksGeneralFailure, netip.AddrPort{})
+		conn.Close()
+		return
+	}
+	a := &socksAssociation{
+		server:   s,
+		relay:    relay,
+		client:   conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap(),
+		sessions: make(map[string]*listener.DatagramSession),
+	}
+	if err := writeSOCKSReply(conn, socksSucceeded, relay.LocalAddr().(*net.UDPAddr).AddrPort()); err != nil {
+		relay.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("SOCKS UDP association", "from", conn.RemoteAddr(), "relay", relay.LocalAddr())
+
+	go a.run()
+	// The association lasts as long as the control connection
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	relay.Close()
+	a.close()
+}
+
+// socksAssociation is a UDP ASSOCIATE: a relay socket for one client and a
+// datagram session per destination.
+type socksAssociation struct {
+	server *socksServer
+	relay  *net.UDPConn
+	client netip.Addr
+
+	mu         sync.Mutex
+	clientAddr netip.AddrPort
+	sessions   map[string]*listener.DatagramSession
+}
+
+func (a *socksAssociation) run() {
+	buf := make([]byte, UDP_MAX_DATAGRAM_SIZE)
+	for {
+		n, from, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		// Only the client of the control connection may use the relay
+		if from.Addr().Unmap() != a.client {
+			continue
+		}
+		packet := buf[:n]
+		// RSV(2) FRAG(1), fragments are not supported
+		if len(packet) < 4 || packet[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(packet[4:])
+		dst, target, err := readSOCKSAddr(r, packet[3])
+		if err != nil {
+			continue
+		}
+		header, data := packet[:n-r.Len()], packet[n-r.Len():]
+		session := a.session(from, dst, target, header)
+		if session == nil {
+			continue
+		}
+		if err := session.Send(data); err != nil {
+			slog.Error("Cannot send Datagram", "ID", session.ID, "err", err)
+		}
+	}
+}
+
+// session returns the datagram session towards target, opening it on the
+// first datagram.
+func (a *socksAssociation) session(from netip.AddrPort, dst netip.Addr, target mapping.Target, header []byte) *listener.DatagramSession {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clientAddr = from
+	key := target.String()
+	if session, ok := a.sessions[key]; ok {
+		return session
+	}
+	agent := agentFor(a.server.routes, dst)
+	if agent == nil {
+		return nil
+	}
+	session := agent.OpenDatagramSession(target.IP, target.Host, target.Port)
+	a.sessions[key] = session
+	go a.reply(key, session, append([]byte(nil), header...))
+	return session
+}
+
+// reply sends the target's datagrams back to the client, behind the same
+// header the client used.
+func (a *socksAssociation) reply(key string, session *listener.DatagramSession, header []byte) {
+	defer func() {
+		a.mu.Lock()
+		if a.sessions[key] == session {
+			delete(a.sessions, key)
+		}
+		a.mu.Unlock()
+	}()
+	for {
+		select {
+		case data := <-session.Recv():
+			a.mu.Lock()
+			to := a.clientAddr
+			a.mu.Unlock()
+			packet := append(append([]byte(nil), header...), data...)
+			if _, err := a.relay.WriteToUDPAddrPort(packet, to); err != nil && errors.Is(err, net.ErrClosed) {
+				return
+			}
+		case <-session.Done():
+			return
+		}
+	}
+}
+
+func (a *socksAssociation) close() {
+	a.mu.Lock()
+	sessions := make([]*listener.DatagramSession, 0, len(a.sessions))
+	for _, session := range a.sessions {
+		sessions = append(sessions, session)
+	}
+	a.mu.Unlock()
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+// readSOCKSAddr reads DST.ADDR and DST.PORT of type atyp. It returns the
+// address to route on, 0.0.0.0 for a host name, and the agent's target.
+func readSOCKSAddr(r io.Reader, atyp byte) (netip.Addr, mapping.Target, error) {
+	var target mapping.Target
+	var dst netip.Addr
+	switch atyp {
+	case socksIPv4, socksIPv6:
+		size := 4
+		if atyp == socksIPv6 {
+			size = 16
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return dst, target, err
+		}
+		dst, _ = netip.AddrFromSlice(ip)
+		target.IP = ip
+	case socksDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return dst, target, err
+		}
+		host := make([]byte, size[0])
+		if _, err := io.ReadFull(r, host); err != nil {
+			return dst, target, err
+		}
+		dst, target = hostTarget(string(host))
+	default:
+		return dst, target, fmt.Errorf("%w %d", errSOCKSAddress, atyp)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return dst, target, err
+	}
+	target.Port = binary.BigEndian.Uint16(port[:])
+	return dst, target, nil
+}
+
+func writeSOCKSReply(w io.Writer, rep byte, bind netip.AddrPort) error {
+	reply := []byte{socksVersion, rep, 0}
+	addr := bind.Addr().Unmap()
+	if addr.Is6() {
+		reply = append(reply, socksIPv6)
+	} else {
+		reply = append(reply, socksIPv4)
+		if !addr.IsValid() {
+			addr = netip.IPv4Unspecified()
+		}
+	}
+	reply = append(reply, addr.AsSlice()...)
+	reply = binary.BigEndian.AppendUint16(reply, bind.Port())
+	_, err := w.Write(reply)
+	return err
+}
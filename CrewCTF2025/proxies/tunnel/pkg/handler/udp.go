@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/tunneling/pkg/listener"
+	"github.com/tunneling/pkg/mapping"
+	"github.com/tunneling/pkg/routing"
+	"github.com/tunneling/pkg/util"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const UDP_IDLE_TIMEOUT = 60 * time.Second
+const UDP_MAX_DATAGRAM_SIZE = 65535
+
+func UDPHandler(ustack *stack.Stack, nicID tcpip.NICID, procCtx context.Context, routes *routing.Table, mapper *mapping.Mapper) (*udp.Forwarder, error) {
+	udpForwarder := udp.NewForwarder(ustack, func(req *udp.ForwarderRequest) bool {
+		reqID := req.ID()
+		slog.Info("UDP forward request:", slog.String("from", util.FromNetstackIP(reqID.RemoteAddress).String()), slog.String("to", util.FromNetstackIP(reqID.LocalAddress).String()))
+		addLocalAddress(ustack, nicID, reqID.LocalAddress)
+
+		agent := agentFor(routes, util.FromNetstackIP(reqID.LocalAddress))
+		if agent == nil {
+			return true
+		}
+
+		var wq waiter.Queue
+		endpoint, tcpErr := req.CreateEndpoint(&wq)
+		if tcpErr != nil {
+			slog.Error("Failed to create UDP endpoint", "err", tcpErr)
+			return true
+		}
+		client := gonet.NewUDPConn(&wq, endpoint)
+		target := mapper.Resolve(netip.AddrPortFrom(util.FromNetstackIP(reqID.LocalAddress), reqID.LocalPort))
+		session := agent.OpenDatagramSession(target.IP, target.Host, target.Port)
+
+		go handleDatagrams(procCtx, client, session)
+		return true
+	})
+	return udpForwarder, nil
+}
+
+// handleDatagrams relays one UDP flow until it has been idle for
+// UDP_IDLE_TIMEOUT or the agent ends the session.
+func handleDatagrams(procCtx context.Context, client *gonet.UDPConn, session *listener.DatagramSession) {
+	defer client.Close()
+	defer session.Close()
+
+	idle := time.NewTimer(UDP_IDLE_TIMEOUT)
+	defer idle.Stop()
+	activity := make(chan struct{}, 1)
+	touch := func() {
+		select {
+		case activity <- struct{}{}:
+		default:
+		}
+	}
+
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		buf := make([]byte, UDP_MAX_DATAGRAM_SIZE)
+		for {
+			n, err := client.Read(buf)
+			if err != nil {
+				return
+			}
+			touch()
+			if err := session.Send(buf[:n]); err != nil {
+				slog.Error("Cannot send Datagram", "ID", session.ID, "err", err)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case data := <-session.Recv():
+			idle.Reset(UDP_IDLE_TIMEOUT)
+			if _, err := client.Write(data); err != nil {
+				slog.Error("Write to UDP client failed", "ID", session.ID, "err", err)
+				return
+			}
+		case <-activity:
+			idle.Reset(UDP_IDLE_TIMEOUT)
+		case <-idle.C:
+			slog.Info("UDP session idle, closing", "ID", session.ID)
+			return
+		case <-session.Done():
+			return
+		case <-clientDone:
+			return
+		case <-procCtx.Done():
+			return
+		}
+	}
+}
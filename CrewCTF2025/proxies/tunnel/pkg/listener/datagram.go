@@ -0,0 +1,95 @@
+package listener
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// DATAGRAM_QUEUE_LEN is how many datagrams from the agent are buffered per
+// session before further ones are dropped, the way a full socket buffer would.
+const DATAGRAM_QUEUE_LEN = 64
+
+// DatagramSession is a UDP flow relayed through the agent. The agent keeps a
+// socket per session and closes it after it has been idle for a while.
+type DatagramSession struct {
+	ID uint32
+
+	ac   *AgentConn
+	ip   []byte
+	host string
+	port uint16
+
+	recv      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenDatagramSession starts a UDP session towards ip:port (or host:port).
+// Nothing is sent to the agent until the first datagram.
+func (ac *AgentConn) OpenDatagramSession(ip []byte, host string, port uint16) *DatagramSession {
+	s := &DatagramSession{
+		ac:   ac,
+		ip:   ip,
+		host: host,
+		port: port,
+		recv: make(chan []byte, DATAGRAM_QUEUE_LEN),
+		done: make(chan struct{}),
+	}
+
+	ac.Mu.Lock()
+	id := rand.Uint32()
+	for _, exists := ac.datagrams[id]; exists; _, exists = ac.datagrams[id] {
+		id = rand.Uint32()
+	}
+	s.ID = id
+	ac.datagrams[id] = s
+	ac.Mu.Unlock()
+	return s
+}
+
+func (s *DatagramSession) Send(data []byte) error {
+	return s.ac.Sender.SendDatagram(s.ID, s.ip, s.host, s.port, data)
+}
+
+// Recv returns the datagrams sent back by the target.
+func (s *DatagramSession) Recv() <-chan []byte {
+	return s.recv
+}
+
+// Done is closed once the session ended on either side.
+func (s *DatagramSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *DatagramSession) Close() {
+	if s.finish() {
+		_ = s.ac.Sender.SendDatagramClose(s.ID)
+	}
+}
+
+func (s *DatagramSession) finish() bool {
+	first := false
+	s.closeOnce.Do(func() {
+		first = true
+		close(s.done)
+		s.ac.Mu.Lock()
+		delete(s.ac.datagrams, s.ID)
+		s.ac.Mu.Unlock()
+	})
+	return first
+}
+
+func (s *DatagramSession) deliver(data []byte) bool {
+	select {
+	case s.recv <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ac *AgentConn) getDatagramSession(id uint32) *DatagramSession {
+	ac.Mu.Lock()
+	defer ac.Mu.Unlock()
+	return ac.datagrams[id]
+}
@@ -0,0 +1,78 @@
+package listener
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/tunneling/pkg/filter"
+	"github.com/tunneling/pkg/protocol"
+)
+
+// FORWARD_CONNECT_TIMEOUT bounds the connection to the target of a remote
+// forward.
+const FORWARD_CONNECT_TIMEOUT = 5 * time.Second
+
+// listenForwards has the agent listen for its remote forwards. The listeners
+// live as long as the session.
+func (ac *AgentConn) listenForwards() {
+	for id, f := range ac.forwards {
+		if err := ac.Sender.SendListenRequest(uint32(id), f.Listen); err != nil {
+			slog.Error("Failed to send ListenRequest", "client", ac.Name, "listen", f.Listen, "err", err)
+			return
+		}
+	}
+}
+
+func (ac *AgentConn) forwardListening(resp *protocol.ListenResponse) {
+	if int(resp.ID) >= len(ac.forwards) {
+		slog.Warn("ListenResponse for unknown forward", "client", ac.Name, "ID", resp.ID)
+		return
+	}
+	f := ac.forwards[resp.ID]
+	if !resp.Ok {
+		slog.Error("Agent cannot listen for remote forward", "client", ac.Name, "listen", f.Listen)
+		return
+	}
+	slog.Info("Remote forward listening", "client", ac.Name, "listen", f.Listen, "target", f.Target)
+}
+
+// acceptForward connects to the target of a remote forward for a connection
+// the agent accepted, and pipes it over the agent's stream.
+func (ac *AgentConn) acceptForward(req *protocol.ForwardRequest) {
+	if int(req.ListenID) >= len(ac.forwards) {
+		slog.Warn("ForwardRequest for unknown forward", "client", ac.Name, "ID", req.ListenID)
+		_ = ac.Sender.SendForwardResponse(req.ID, false)
+		return
+	}
+	f := ac.forwards[req.ListenID]
+	// The ID is taken before dialling, so a second request for it is
+	// refused rather than replacing this stream
+	stream := ac.addStream(req.ID)
+	if stream == nil {
+		slog.Warn("ForwardRequest for a stream in use", "client", ac.Name, "ID", req.ID)
+		_ = ac.Sender.SendForwardResponse(req.ID, false)
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", f.Target, FORWARD_CONNECT_TIMEOUT)
+	if err != nil {
+		slog.Error("Failed to connect remote forward", "client", ac.Name, "target", f.Target, "err", err)
+		ac.removeStream(req.ID)
+		_ = ac.Sender.SendForwardResponse(req.ID, false)
+		return
+	}
+
+	if err := ac.Sender.SendForwardResponse(req.ID, true); err != nil {
+		slog.Error("Failed to send ForwardResponse", "err", err)
+		conn.Close()
+		ac.removeStream(req.ID)
+		return
+	}
+	slog.Info("Remote forward connected", "client", ac.Name, "listen", f.Listen, "target", f.Target, "ID", req.ID)
+
+	// The client is on the agent side here: what it sends is written to the
+	// target, what the target answers goes back to it
+	err = protocol.Pipe(filter.NewConn(conn, ac.filters.NewFilter(), filter.ToClient), stream)
+	slog.Info("Remote forward connection closed", "ID", req.ID, "err", err)
+}
@@ -0,0 +1,110 @@
+package listener
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
+	"github.com/tunneling/pkg/protocol"
+)
+
+// The streams of remote forwards go through the filters like any other: the
+// client behind the agent is filtered to_agent, the target's answers
+// to_client.
+func TestRemoteForwardFiltered(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+		conn.Write([]byte("json"))
+	}()
+
+	rules, err := filter.Compile(filter.DefaultRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := NewRegistry(&config.Proxy{
+		DuplicateAgents: config.DuplicateReplace,
+		Agents:          []config.AgentCredential{{Name: "agent-forward"}},
+		Forwards: []config.Forward{{
+			Type:   config.ForwardRemote,
+			Agent:  "agent-forward",
+			Listen: "127.0.0.1:2222",
+			Target: target.Addr().String(),
+		}},
+	}, filter.NewPipeline(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyEnd, agentEnd := net.Pipe()
+	defer agentEnd.Close()
+	go func() {
+		if ac, ok := registerConnection(proxyEnd, registry, 5*time.Second); ok {
+			handleClient(ac)
+		}
+	}()
+	fmt.Fprintf(agentEnd, "agent-forward\n")
+	reader := bufio.NewReader(agentEnd)
+	if line, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("handshake answered %q, %v", line, err)
+	}
+	sender := protocol.NewSender(agentEnd)
+	// The proxy's frames are read as they come, so it never waits on a
+	// write to the pipe
+	frames := make(chan any, 16)
+	go func() {
+		dec := protocol.NewDecoder(reader)
+		for dec.Decode() == nil {
+			if _, ok := dec.Payload.(*protocol.WindowUpdate); !ok {
+				frames <- dec.Payload
+			}
+		}
+	}()
+
+	// next returns the next frame of the proxy, other than window updates.
+	next := func() any {
+		t.Helper()
+		select {
+		case m := <-frames:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("no frame from the proxy")
+			return nil
+		}
+	}
+	if m, ok := next().(*protocol.ListenRequest); !ok || m.ID != 0 {
+		t.Fatalf("got %+v, want the ListenRequest of forward 0", m)
+	}
+	go sender.SendForwardRequest(42, 0)
+	if m, ok := next().(*protocol.ForwardResponse); !ok || m.ID != 42 || !m.Ok {
+		t.Fatalf("got %+v, want an accepted ForwardResponse", m)
+	}
+
+	stream := protocol.NewStream(42, sender, nil)
+	go func() {
+		stream.Write([]byte("give me flag!\n"))
+		stream.CloseWrite()
+	}()
+	if got, want := <-received, "REDACTED     \n"; got != want {
+		t.Errorf("target received %q, want %q", got, want)
+	}
+	if m, ok := next().(*protocol.DataPacket); !ok || string(m.Data) != "json" {
+		t.Errorf("got %+v, want the target's answer as is", m)
+	}
+}
@@ -3,42 +3,283 @@ package listener
 import (
 	"bufio"
 	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
 	"github.com/tunneling/pkg/protocol"
 )
 
 const MAX_CONCURRENT = 100
 
+var (
+	ErrConnectRefused = errors.New("agent refused connection")
+	ErrConnectTimeout = errors.New("timeout waiting for ConnectResponse")
+	ErrEchoTimeout    = errors.New("timeout waiting for EchoReply")
+	ErrAgentClosed    = errors.New("agent connection closed")
+)
+
+// AgentConn is the session of an agent. It outlives the connection: when it
+// drops, the streams are kept for config.SessionResumeTimeout so the agent
+// can reconnect and resume the session with its token.
 type AgentConn struct {
-	Conn net.Conn
+	Name    string
+	Session string
+	Conn    net.Conn
+	Sender  *protocol.Sender
 
-	Mu         sync.Mutex
-	DataChans  map[uint32]chan *protocol.DataPacket
-	CloseChans map[uint32]chan *protocol.CloseRequest
+	// reader holds whatever the agent sent right after its handshake line.
+	reader *bufio.Reader
+	// readDone is closed once the read loop of Conn has finished.
+	readDone chan struct{}
+	// dropped marks a session closed on purpose, which is not kept for
+	// resumption.
+	dropped atomic.Bool
+	// attachGen counts the connections of the session, it is guarded by
+	// clientsMu along with expiry.
+	attachGen uint64
+	expiry    *time.Timer
 
-	ConnRespChan chan *protocol.ConnectResponse
+	Mu        sync.Mutex
+	Streams   map[uint32]*protocol.Stream
+	datagrams map[uint32]*DatagramSession
+
+	// forwards are the agent's remote forwards, by ID, and filters runs on
+	// their streams.
+	forwards []config.Forward
+	filters  filter.Factory
+
+	pendingMu    sync.Mutex
+	pending      map[uint32]chan *protocol.Stream
+	pendingEchos map[uint32]chan bool
+	closed       chan struct{}
 }
 
+// clients holds the connected sessions of each agent, oldest first. There is
+// more than one only with the "keep" duplicate policy. sessions holds every
+// session by token, including the ones waiting to be resumed.
 var (
-	clients   = make(map[string]*AgentConn)
+	clients   = make(map[string][]*AgentConn)
+	sessions  = make(map[string]*AgentConn)
 	clientsMu sync.Mutex
 )
 
-func (ac *AgentConn) readLoop(name string) {
+// Connect asks the agent to dial ip:port (or host:port) and waits for the ConnectResponse
+// carrying the same request ID. The returned stream is already registered, so
+// no data sent by the agent right after accepting is lost.
+func (ac *AgentConn) Connect(ip []byte, host string, port uint16, timeout time.Duration) (*protocol.Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stream, err := ac.ConnectContext(ctx, ip, host, port)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrConnectTimeout
+	}
+	return stream, err
+}
+
+// ConnectContext is Connect, giving up when ctx is done.
+func (ac *AgentConn) ConnectContext(ctx context.Context, ip []byte, host string, port uint16) (*protocol.Stream, error) {
+	respCh := make(chan *protocol.Stream, 1)
+
+	ac.pendingMu.Lock()
+	reqID := rand.Uint32()
+	for _, exists := ac.pending[reqID]; exists; _, exists = ac.pending[reqID] {
+		reqID = rand.Uint32()
+	}
+	ac.pending[reqID] = respCh
+	ac.pendingMu.Unlock()
+	closed := ac.connClosed()
+
 	defer func() {
-		DeleteClient(name)
-		slog.Info("Connection is closed and removed", "client", name)
+		ac.pendingMu.Lock()
+		delete(ac.pending, reqID)
+		ac.pendingMu.Unlock()
 	}()
-	dec := protocol.NewDecoder(ac.Conn)
+
+	// While the agent is away the sender is paused, the request waits for
+	// it to come back within ctx
+	if err := ac.Sender.SendConnectRequest(ctx, ip, host, port, reqID); err != nil {
+		return nil, err
+	}
+
+	select {
+	case stream := <-respCh:
+		if stream == nil {
+			return nil, ErrConnectRefused
+		}
+		return stream, nil
+	case <-ctx.Done():
+	case <-closed:
+		return nil, ErrAgentClosed
+	}
+
+	// The response may have been dispatched while ctx was done.
+	select {
+	case stream := <-respCh:
+		if stream != nil {
+			stream.Close()
+		}
+	default:
+	}
+	return nil, ctx.Err()
+}
+
+func (ac *AgentConn) dispatchConnectResponse(resp *protocol.ConnectResponse) {
+	ac.pendingMu.Lock()
+	ch, ok := ac.pending[resp.ReqID]
+	delete(ac.pending, resp.ReqID)
+	ac.pendingMu.Unlock()
+
+	if !ok {
+		slog.Warn("No pending connect for ConnectResponse", "reqID", resp.ReqID)
+		if resp.Ok {
+			// The requester gave up already, so nobody will ever use this
+			// connection on the agent side.
+			_ = ac.Sender.SendCloseRequest(resp.ID)
+		}
+		return
+	}
+
+	if !resp.Ok {
+		ch <- nil
+		return
+	}
+	stream := ac.addStream(resp.ID)
+	if stream == nil {
+		// Never replace a live stream, the agent has to drop the new one
+		slog.Error("ConnectResponse for a stream in use", "client", ac.Name, "ID", resp.ID)
+		_ = ac.Sender.SendResetRequest(resp.ID)
+		ch <- nil
+		return
+	}
+	ch <- stream
+}
+
+// Echo asks the agent to ping ip (or host) and reports whether the target answered
+// within timeout.
+func (ac *AgentConn) Echo(ip []byte, host string, data []byte, timeout time.Duration) (bool, error) {
+	replyCh := make(chan bool, 1)
+
+	ac.pendingMu.Lock()
+	reqID := rand.Uint32()
+	for _, exists := ac.pendingEchos[reqID]; exists; _, exists = ac.pendingEchos[reqID] {
+		reqID = rand.Uint32()
+	}
+	ac.pendingEchos[reqID] = replyCh
+	ac.pendingMu.Unlock()
+	closed := ac.connClosed()
+
+	defer func() {
+		ac.pendingMu.Lock()
+		delete(ac.pendingEchos, reqID)
+		ac.pendingMu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ac.Sender.SendEchoRequest(ctx, reqID, ip, host, data); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return false, ErrEchoTimeout
+		}
+		return false, err
+	}
+
+	select {
+	case ok := <-replyCh:
+		return ok, nil
+	case <-ctx.Done():
+		return false, ErrEchoTimeout
+	case <-closed:
+		return false, ErrAgentClosed
+	}
+}
+
+func (ac *AgentConn) dispatchEchoReply(reply *protocol.EchoReply) {
+	ac.pendingMu.Lock()
+	ch, ok := ac.pendingEchos[reply.ID]
+	delete(ac.pendingEchos, reply.ID)
+	ac.pendingMu.Unlock()
+
+	if ok {
+		ch <- reply.Ok
+	}
+}
+
+// Load returns the number of streams and datagram sessions the agent is
+// carrying.
+func (ac *AgentConn) Load() int {
+	ac.Mu.Lock()
+	defer ac.Mu.Unlock()
+	return len(ac.Streams) + len(ac.datagrams)
+}
+
+func (ac *AgentConn) getStream(id uint32) *protocol.Stream {
+	ac.Mu.Lock()
+	defer ac.Mu.Unlock()
+	return ac.Streams[id]
+}
+
+// addStream registers a new stream under id. It returns nil if a live stream
+// has that ID already.
+func (ac *AgentConn) addStream(id uint32) *protocol.Stream {
+	ac.Mu.Lock()
+	defer ac.Mu.Unlock()
+	if _, exists := ac.Streams[id]; exists {
+		return nil
+	}
+	stream := protocol.NewStream(id, ac.Sender, ac.removeStream)
+	ac.Streams[id] = stream
+	return stream
+}
+
+func (ac *AgentConn) removeStream(id uint32) {
+	ac.Mu.Lock()
+	delete(ac.Streams, id)
+	ac.Mu.Unlock()
+}
+
+// connClosed returns a channel closed when the current connection is lost.
+func (ac *AgentConn) connClosed() <-chan struct{} {
+	ac.Mu.Lock()
+	defer ac.Mu.Unlock()
+	return ac.closed
+}
+
+func (ac *AgentConn) streams() []*protocol.Stream {
+	ac.Mu.Lock()
+	defer ac.Mu.Unlock()
+	streams := make([]*protocol.Stream, 0, len(ac.Streams))
+	for _, stream := range ac.Streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (ac *AgentConn) readLoop() {
+	ac.Mu.Lock()
+	reader, closed, done := ac.reader, ac.closed, ac.readDone
+	ac.Mu.Unlock()
+	defer ac.detach(closed, done)
+
+	dec := protocol.NewDecoder(reader)
+	dec.SetMaxFrameSize(config.MaxFrameSize)
 	for {
 		if err := dec.Decode(); err != nil {
+			if errors.Is(err, protocol.ErrUnknownMessage) {
+				slog.Warn("Skipping frame", "err", err)
+				continue
+			}
 			slog.Error("AgentConn decode failed", "err", err)
 			return
 		}
@@ -46,26 +287,68 @@ func (ac *AgentConn) readLoop(name string) {
 		switch pkt := dec.Payload.(type) {
 
 		case *protocol.ConnectResponse:
-			ac.ConnRespChan <- pkt
+			ac.dispatchConnectResponse(pkt)
 
 		case *protocol.DataPacket:
-			ac.Mu.Lock()
-			ch, ok := ac.DataChans[pkt.ID]
-			ac.Mu.Unlock()
-			if ok {
-				ch <- pkt
-			} else {
+			stream := ac.getStream(pkt.ID)
+			if stream == nil {
 				slog.Warn("No handler for DataPacket", "ID", pkt.ID)
+				continue
+			}
+			if err := stream.Deliver(pkt.Data); errors.Is(err, protocol.ErrWindowExceeded) {
+				slog.Error("Dropping stream", "ID", pkt.ID, "err", err)
+				stream.Reset()
+			}
+
+		case *protocol.WindowUpdate:
+			if stream := ac.getStream(pkt.ID); stream != nil {
+				stream.AddCredit(pkt.Increment)
 			}
 
 		case *protocol.CloseRequest:
-			ac.Mu.Lock()
-			ch, ok := ac.CloseChans[pkt.ID]
-			ac.Mu.Unlock()
-			if ok {
-				ch <- pkt
-			} else {
+			stream := ac.getStream(pkt.ID)
+			if stream == nil {
 				slog.Warn("No handler for CloseRequest", "ID", pkt.ID)
+				continue
+			}
+			stream.CloseWithError(protocol.ErrStreamClosed)
+
+		case *protocol.CloseWriteRequest:
+			if stream := ac.getStream(pkt.ID); stream != nil {
+				stream.RemoteCloseWrite()
+			}
+
+		case *protocol.ResetRequest:
+			if stream := ac.getStream(pkt.ID); stream != nil {
+				stream.CloseWithError(protocol.ErrStreamReset)
+			}
+
+		case *protocol.EchoReply:
+			ac.dispatchEchoReply(pkt)
+
+		case *protocol.ResumeState:
+			protocol.ResumeStreams(ac.Sender, ac.streams(), pkt)
+
+		case *protocol.ListenResponse:
+			ac.forwardListening(pkt)
+
+		case *protocol.ForwardRequest:
+			// Dialing may take a while, don't hold up the other streams
+			go ac.acceptForward(pkt)
+
+		case *protocol.Datagram:
+			session := ac.getDatagramSession(pkt.ID)
+			if session == nil {
+				slog.Warn("No session for Datagram", "ID", pkt.ID)
+				continue
+			}
+			if !session.deliver(pkt.Data) {
+				slog.Debug("Datagram queue full, dropping", "ID", pkt.ID)
+			}
+
+		case *protocol.DatagramClose:
+			if session := ac.getDatagramSession(pkt.ID); session != nil {
+				session.finish()
 			}
 
 		default:
@@ -74,13 +357,74 @@ func (ac *AgentConn) readLoop(name string) {
 	}
 }
 
-func SpawnListener(ctx context.Context, listenIP string) error {
-	if listenIP == "" {
-		listenIP = "127.0.0.1:19001"
+// detach runs when the connection is lost. Datagram sessions end right away,
+// streams wait for the agent to resume the session.
+func (ac *AgentConn) detach(closed, done chan struct{}) {
+	defer close(done)
+	close(closed)
+	ac.Mu.Lock()
+	datagrams := make([]*DatagramSession, 0, len(ac.datagrams))
+	for _, session := range ac.datagrams {
+		datagrams = append(datagrams, session)
 	}
-	ln, err := net.Listen("tcp", listenIP)
-	if err != nil {
-		return err
+	ac.Mu.Unlock()
+	for _, session := range datagrams {
+		session.finish()
+	}
+
+	if ac.dropped.Load() {
+		ac.expire()
+		return
+	}
+	ac.Sender.Pause()
+	clientsMu.Lock()
+	unpublish(ac)
+	gen := ac.attachGen
+	ac.expiry = time.AfterFunc(config.SessionResumeTimeout, func() {
+		clientsMu.Lock()
+		current := sessions[ac.Session] == ac && ac.attachGen == gen
+		clientsMu.Unlock()
+		if current {
+			ac.expire()
+		}
+	})
+	clientsMu.Unlock()
+	slog.Info("Connection lost, waiting for the agent to resume", "client", ac.Name, "timeout", config.SessionResumeTimeout)
+}
+
+// expire ends the session for good.
+func (ac *AgentConn) expire() {
+	clientsMu.Lock()
+	if sessions[ac.Session] == ac {
+		delete(sessions, ac.Session)
+	}
+	unpublish(ac)
+	clientsMu.Unlock()
+
+	ac.Sender.Fail(ErrAgentClosed)
+	for _, stream := range ac.streams() {
+		stream.CloseWithError(ErrAgentClosed)
+	}
+	ac.Conn.Close()
+	slog.Info("Connection is closed and removed", "client", ac.Name)
+}
+
+// drop closes the session without keeping it for resumption.
+func (ac *AgentConn) drop() {
+	ac.dropped.Store(true)
+	ac.Mu.Lock()
+	conn := ac.Conn
+	ac.Mu.Unlock()
+	conn.Close()
+}
+
+// SpawnListener accepts agents on ln, any transport's listener. secure, when
+// not nil, wraps the listener to authenticate and encrypt the agent link, see
+// TLSListener and NoiseListener. Call it once per transport to serve several
+// at once.
+func SpawnListener(ctx context.Context, ln net.Listener, registry *Registry, secure func(net.Listener) net.Listener) error {
+	if secure != nil {
+		ln = secure(ln)
 	}
 
 	go func() {
@@ -96,18 +440,22 @@ func SpawnListener(ctx context.Context, listenIP string) error {
 				case <-ctx.Done():
 					return
 				default:
+					if errors.Is(err, net.ErrClosed) {
+						slog.Error("Listener closed", "addr", ln.Addr())
+						return
+					}
 					slog.Error("Accept failed", "err", err)
 					continue
 				}
 			}
 
 			go func(c net.Conn) {
-				name, ok := registerConnection(c, 10*time.Second)
+				ac, ok := registerConnection(c, registry, 10*time.Second)
 				if !ok {
 					c.Close()
 					return
 				}
-				handleClient(name)
+				handleClient(ac)
 			}(conn)
 		}
 	}()
@@ -115,55 +463,203 @@ func SpawnListener(ctx context.Context, listenIP string) error {
 	return nil
 }
 
-func handleClient(name string) {
-	slog.Info("Connection is now alive with", "client", name)
-	ac := GetClient(name)
-	if ac == nil {
-		slog.Error("Cannot get the client", "name", name)
-		return
-	}
-	go ac.readLoop(name)
+func handleClient(ac *AgentConn) {
+	slog.Info("Connection is now alive with", "client", ac.Name)
+	go ac.readLoop()
 }
 
-func registerConnection(conn net.Conn, timeout time.Duration) (string, bool) {
+// registerConnection reads the "<name> [<token>] [resume=<session>]"
+// handshake line, checks it against the registry and answers
+// "OK <session>" or "ERR <reason>". A known session token resumes that
+// session on the new connection. Over TLS or Noise the name comes from the
+// client certificate or key instead, and no token is needed.
+func registerConnection(conn net.Conn, registry *Registry, timeout time.Duration) (*AgentConn, bool) {
 	conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	keyName, err := transportName(conn, registry)
+	if err != nil {
+		slog.Error("Cannot identify agent", "addr", conn.RemoteAddr(), "err", err)
+		return nil, false
+	}
 
 	reader := bufio.NewReader(conn)
-	nameRaw, err := reader.ReadString('\n')
+	line, err := reader.ReadString('\n')
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			slog.Error("Client read name timeout after", slog.Duration("interval", timeout))
 		} else {
 			slog.Error("Failed to read name", "err", err)
 		}
-		return "", false
+		return nil, false
 	}
 
 	conn.SetReadDeadline(time.Time{})
 
-	name := strings.TrimSpace(nameRaw)
-	if name == "" {
-		return "", false
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, false
+	}
+	name, token, session := fields[0], "", ""
+	for _, field := range fields[1:] {
+		if s, ok := strings.CutPrefix(field, "resume="); ok {
+			session = s
+		} else {
+			token = field
+		}
 	}
-	if name != config.AgentName {
-		return "", false
+	if keyName != "" {
+		if name != keyName {
+			slog.Info("Using authenticated name", "sent", name, "name", keyName)
+		}
+		name = keyName
 	}
-	if c := GetClient(name); c != nil {
-		c.Conn.Close()
+	authorized := registry.Authenticate(name, token)
+	if keyName != "" {
+		authorized = registry.Known(name)
 	}
-	clientsMu.Lock()
-	clients[name] = &AgentConn{
+	if !authorized {
+		slog.Warn("Rejected agent", "name", name, "addr", conn.RemoteAddr())
+		fmt.Fprintf(conn, "ERR unauthorized\n")
+		return nil, false
+	}
+
+	// The answer is written before the connection is published, so it
+	// cannot interleave with frames sent through the Sender.
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	if session != "" {
+		if ac, ok := resumeSession(name, session, conn, reader, registry); ac != nil {
+			return ac, ok
+		}
+		slog.Info("Unknown session, starting a new one", "name", name)
+	}
+
+	sender := protocol.NewSender(conn)
+	sender.SetMaxFrameSize(config.MaxFrameSize)
+	ac := &AgentConn{
+		Name:         name,
+		Session:      newSessionToken(),
 		Conn:         conn,
-		DataChans:    make(map[uint32]chan *protocol.DataPacket),
-		CloseChans:   make(map[uint32]chan *protocol.CloseRequest),
-		ConnRespChan: make(chan *protocol.ConnectResponse, 1),
+		Sender:       sender,
+		reader:       reader,
+		readDone:     make(chan struct{}),
+		Streams:      make(map[uint32]*protocol.Stream),
+		datagrams:    make(map[uint32]*DatagramSession),
+		pending:      make(map[uint32]chan *protocol.Stream),
+		pendingEchos: make(map[uint32]chan bool),
+		closed:       make(chan struct{}),
+		forwards:     registry.forwards[name],
+		filters:      registry.filters,
+	}
+	if !publish(ac, registry) {
+		return nil, false
 	}
-	clientsMu.Unlock()
 	slog.Info("Client connected", "name", name)
-	return name, true
+	ac.listenForwards()
+	return ac, true
+}
+
+// resumeSession moves the session to conn. It returns nil if there is no
+// such session for name, so a new one should be started instead.
+func resumeSession(name, session string, conn net.Conn, reader *bufio.Reader, registry *Registry) (*AgentConn, bool) {
+	clientsMu.Lock()
+	ac := sessions[session]
+	clientsMu.Unlock()
+	if ac == nil || ac.Name != name {
+		return nil, false
+	}
+
+	// The agent may be back before its old connection was found dead
+	ac.Mu.Lock()
+	old, done := ac.Conn, ac.readDone
+	ac.Mu.Unlock()
+	old.Close()
+	<-done
+
+	clientsMu.Lock()
+	if sessions[session] != ac {
+		clientsMu.Unlock()
+		return nil, false
+	}
+	ac.attachGen++
+	if ac.expiry != nil {
+		ac.expiry.Stop()
+	}
+	clientsMu.Unlock()
+
+	ac.Mu.Lock()
+	ac.Conn = conn
+	ac.reader = reader
+	ac.closed = make(chan struct{})
+	ac.readDone = make(chan struct{})
+	ac.Mu.Unlock()
+
+	if !publish(ac, registry) {
+		ac.expire()
+		return ac, false
+	}
+	ac.Sender.Attach(conn)
+	if err := ac.Sender.SendResumeState(ac.streams()); err != nil {
+		slog.Error("Failed to send ResumeState", "name", name, "err", err)
+		ac.expire()
+		return ac, false
+	}
+	slog.Info("Client resumed its session", "name", name)
+	return ac, true
+}
+
+// publish applies the duplicate policy, accepts the agent and makes it
+// available to GetClient.
+func publish(ac *AgentConn, registry *Registry) bool {
+	clientsMu.Lock()
+	existing := clients[ac.Name]
+	if len(existing) > 0 && registry.duplicates == config.DuplicateReject {
+		clientsMu.Unlock()
+		slog.Warn("Rejected duplicate agent", "name", ac.Name, "addr", ac.Conn.RemoteAddr())
+		fmt.Fprintf(ac.Conn, "ERR duplicate name\n")
+		return false
+	}
+	if _, err := fmt.Fprintf(ac.Conn, "OK %s\n", ac.Session); err != nil {
+		clientsMu.Unlock()
+		slog.Error("Failed to acknowledge agent", "name", ac.Name, "err", err)
+		return false
+	}
+	sessions[ac.Session] = ac
+	if registry.duplicates == config.DuplicateKeep {
+		clients[ac.Name] = append(existing, ac)
+		existing = nil
+	} else {
+		clients[ac.Name] = []*AgentConn{ac}
+	}
+	clientsMu.Unlock()
+
+	for _, old := range existing {
+		slog.Info("Replacing agent connection", "name", ac.Name, "addr", old.Conn.RemoteAddr())
+		old.drop()
+	}
+	return true
+}
+
+// unpublish hides ac from GetClient. clientsMu must be held.
+func unpublish(ac *AgentConn) {
+	conns := slices.DeleteFunc(clients[ac.Name], func(c *AgentConn) bool { return c == ac })
+	if len(conns) == 0 {
+		delete(clients, ac.Name)
+	} else {
+		clients[ac.Name] = conns
+	}
+}
+
+func newSessionToken() string {
+	var token [16]byte
+	crand.Read(token[:])
+	return hex.EncodeToString(token[:])
 }
 
 func GetClientNames() []string {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
 	names := make([]string, 0, len(clients))
 	for name := range clients {
 		names = append(names, name)
@@ -171,33 +667,31 @@ func GetClientNames() []string {
 	return names
 }
 
+// GetClient returns the oldest live connection of the named agent.
 func GetClient(name string) *AgentConn {
 	clientsMu.Lock()
-	c, ok := clients[name]
-	clientsMu.Unlock()
-	if !ok {
-		return nil
+	defer clientsMu.Unlock()
+	if conns := clients[name]; len(conns) > 0 {
+		return conns[0]
 	}
-	return c
+	return nil
 }
 
-func Ping(conn net.Conn) bool {
-	if err := protocol.SendPingRequest(conn); err != nil {
+func Ping(sender *protocol.Sender) bool {
+	if err := sender.SendPingRequest(); err != nil {
 		slog.Error("Failed to send PingRequest", "err", err)
 		return false
 	}
 	return true
 }
 
+// DeleteClient closes every session of the named agent.
 func DeleteClient(name string) {
 	clientsMu.Lock()
-	c, ok := clients[name]
-	clientsMu.Unlock()
-	if !ok {
-		return
-	}
-	c.Conn.Close()
-	clientsMu.Lock()
+	conns := clients[name]
 	delete(clients, name)
 	clientsMu.Unlock()
+	for _, c := range conns {
+		c.drop()
+	}
 }
@@ -0,0 +1,111 @@
+package listener
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
+	"github.com/tunneling/pkg/noise"
+)
+
+// Registry holds the agents allowed to attach, with their credentials, and
+// the policy for agents connecting under a name that is already in use.
+type Registry struct {
+	// tokens maps an agent name to the digest of its token, nil when the
+	// agent needs no token.
+	tokens     map[string]*[sha256.Size]byte
+	keys       map[noise.Key]string
+	duplicates string
+	// forwards holds the remote forwards of each agent, the index of a
+	// forward is its ID on the agent link.
+	forwards map[string][]config.Forward
+	// filters runs on the streams of remote forwards.
+	filters filter.Factory
+}
+
+func NewRegistry(cfg *config.Proxy, filters filter.Factory) (*Registry, error) {
+	switch cfg.DuplicateAgents {
+	case config.DuplicateReplace, config.DuplicateReject, config.DuplicateKeep:
+	default:
+		return nil, fmt.Errorf("unknown duplicate agent policy: %q", cfg.DuplicateAgents)
+	}
+
+	r := &Registry{
+		tokens:     make(map[string]*[sha256.Size]byte),
+		keys:       make(map[noise.Key]string),
+		duplicates: cfg.DuplicateAgents,
+		forwards:   make(map[string][]config.Forward),
+		filters:    filters,
+	}
+	for _, f := range cfg.Forwards {
+		if f.Agent == "" || f.Listen == "" || f.Target == "" {
+			return nil, fmt.Errorf("forward %s needs an agent, a listen and a target address", f.Listen)
+		}
+		switch f.Type {
+		case config.ForwardLocal:
+		case config.ForwardRemote:
+			r.forwards[f.Agent] = append(r.forwards[f.Agent], f)
+		default:
+			return nil, fmt.Errorf("unknown forward type: %q", f.Type)
+		}
+	}
+	if len(cfg.Agents) == 0 {
+		r.tokens[config.AgentName] = nil
+		return r, nil
+	}
+	for _, agent := range cfg.Agents {
+		if agent.Name == "" {
+			return nil, fmt.Errorf("agent without a name")
+		}
+		if _, exists := r.tokens[agent.Name]; exists {
+			return nil, fmt.Errorf("agent %q listed twice", agent.Name)
+		}
+		if agent.PublicKey != "" {
+			key, err := noise.ParseKey(agent.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("agent %q: %w", agent.Name, err)
+			}
+			if other, exists := r.keys[key]; exists {
+				return nil, fmt.Errorf("agents %q and %q share a public key", other, agent.Name)
+			}
+			r.keys[key] = agent.Name
+		}
+		if agent.Token == "" {
+			slog.Warn("Agent accepted without a token", "name", agent.Name)
+			r.tokens[agent.Name] = nil
+			continue
+		}
+		digest := sha256.Sum256([]byte(agent.Token))
+		r.tokens[agent.Name] = &digest
+	}
+	return r, nil
+}
+
+// NameForKey returns the agent owning the Noise static key.
+func (r *Registry) NameForKey(key noise.Key) (string, bool) {
+	name, ok := r.keys[key]
+	return name, ok
+}
+
+// Known reports whether name is an agent allowed to attach.
+func (r *Registry) Known(name string) bool {
+	_, known := r.tokens[name]
+	return known
+}
+
+// Authenticate reports whether name is a known agent and token its
+// credential.
+func (r *Registry) Authenticate(name, token string) bool {
+	want, known := r.tokens[name]
+	if !known {
+		return false
+	}
+	if want == nil {
+		return true
+	}
+	got := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
@@ -0,0 +1,87 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/noise"
+)
+
+var ErrNoClientCert = errors.New("no client certificate")
+
+// ServerTLSConfig builds the listener side of mutual TLS: agents must present
+// a certificate signed by cfg.CA.
+func ServerTLSConfig(cfg *config.TLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	pem, err := os.ReadFile(cfg.CA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in CA file %s", cfg.CA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// TLSListener secures the agent link with mutual TLS.
+func TLSListener(cfg *tls.Config) func(net.Listener) net.Listener {
+	return func(ln net.Listener) net.Listener {
+		return tls.NewListener(ln, cfg)
+	}
+}
+
+// NoiseListener secures the agent link with a Noise IK handshake, only the
+// agents with a public key in the registry get through.
+func NoiseListener(static noise.KeyPair, registry *Registry) func(net.Listener) net.Listener {
+	return func(ln net.Listener) net.Listener {
+		return noise.NewListener(ln, static, func(key noise.Key) bool {
+			_, ok := registry.NameForKey(key)
+			return ok
+		})
+	}
+}
+
+// transportName runs the handshake of a secured connection and returns the
+// agent name it authenticated, "" for a cleartext connection.
+func transportName(conn net.Conn, registry *Registry) (string, error) {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if err := c.Handshake(); err != nil {
+			return "", fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		certs := c.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			return "", ErrNoClientCert
+		}
+		name := certs[0].Subject.CommonName
+		if name == "" {
+			return "", fmt.Errorf("client certificate without a common name")
+		}
+		return name, nil
+
+	case *noise.Conn:
+		if err := c.Handshake(); err != nil {
+			return "", err
+		}
+		name, ok := registry.NameForKey(c.PeerKey())
+		if !ok {
+			return "", fmt.Errorf("%w: %s", noise.ErrPeerRejected, c.PeerKey())
+		}
+		return name, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,80 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/tunneling/internal/testpki"
+	"github.com/tunneling/pkg/config"
+)
+
+func TestTLSAgentName(t *testing.T) {
+	ca, other := testpki.NewCA(t, "agents"), testpki.NewCA(t, "other")
+	certPEM, keyPEM := ca.Issue(t, "proxy", x509.ExtKeyUsageServerAuth, "proxy.test")
+	cfg, err := ServerTLSConfig(&config.TLS{
+		CA:   testpki.WriteFile(t, "ca.pem", ca.PEM),
+		Cert: testpki.WriteFile(t, "cert.pem", certPEM),
+		Key:  testpki.WriteFile(t, "key.pem", keyPEM),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = TLSListener(cfg)(ln)
+	defer ln.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		want    string
+		wantErr bool
+	}{
+		{"common name", []tls.Certificate{ca.TLSCert(t, "agent-1", x509.ExtKeyUsageClientAuth)}, "agent-1", false},
+		{"no certificate", nil, "", true},
+		{"other CA", []tls.Certificate{other.TLSCert(t, "agent-1", x509.ExtKeyUsageClientAuth)}, "", true},
+		{"no common name", []tls.Certificate{ca.TLSCert(t, "", x509.ExtKeyUsageClientAuth)}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			go func() {
+				conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+					Certificates: tt.certs,
+					RootCAs:      roots,
+					ServerName:   "proxy.test",
+				})
+				if err != nil {
+					return
+				}
+				// Wait for the listener's verdict
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			}()
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			name, err := transportName(conn, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got agent %q, want an error", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.want {
+				t.Errorf("got agent %q, want %q", name, tt.want)
+			}
+		})
+	}
+}
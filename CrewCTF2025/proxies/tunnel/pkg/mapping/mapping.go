@@ -0,0 +1,131 @@
+package mapping
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/tunneling/pkg/config"
+)
+
+// Target is where the agent connects for a flow. Host is set instead of IP
+// when the target is a name the agent has to resolve.
+type Target struct {
+	IP   []byte
+	Host string
+	Port uint16
+}
+
+func (t Target) String() string {
+	host := t.Host
+	if host == "" {
+		addr, _ := netip.AddrFromSlice(t.IP)
+		host = addr.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(t.Port)))
+}
+
+type target struct {
+	Target
+	keepPort bool
+}
+
+// Mapper translates the destination a TUN client asked for into the target
+// the agent should connect to.
+type Mapper struct {
+	mode   string
+	byAddr map[netip.Addr]target
+	byPort map[netip.AddrPort]target
+}
+
+func New(cfg config.Destinations) (*Mapper, error) {
+	switch cfg.Mode {
+	case config.DestinationLoopback, config.DestinationPassthrough:
+	default:
+		return nil, fmt.Errorf("unknown destination mode: %q", cfg.Mode)
+	}
+
+	m := &Mapper{
+		mode:   cfg.Mode,
+		byAddr: make(map[netip.Addr]target),
+		byPort: make(map[netip.AddrPort]target),
+	}
+	for _, entry := range cfg.Map {
+		t, err := parseTarget(entry.Target)
+		if err != nil {
+			return nil, fmt.Errorf("bad target for %s: %w", entry.Virtual, err)
+		}
+		if addrPort, err := netip.ParseAddrPort(entry.Virtual); err == nil {
+			m.byPort[unmap(addrPort)] = t
+			continue
+		}
+		addr, err := netip.ParseAddr(entry.Virtual)
+		if err != nil {
+			return nil, fmt.Errorf("bad virtual address %q", entry.Virtual)
+		}
+		m.byAddr[addr.Unmap()] = t
+	}
+	return m, nil
+}
+
+// Resolve returns the agent-side target for dst. Exact ip:port entries win
+// over ip entries, addresses without an entry follow the configured mode.
+func (m *Mapper) Resolve(dst netip.AddrPort) Target {
+	dst = unmap(dst)
+	t, ok := m.byPort[dst]
+	if !ok {
+		t, ok = m.byAddr[dst.Addr()]
+	}
+	if ok {
+		if t.keepPort {
+			t.Port = dst.Port()
+		}
+		return t.Target
+	}
+
+	if m.mode == config.DestinationPassthrough {
+		return Target{IP: dst.Addr().AsSlice(), Port: dst.Port()}
+	}
+	return Target{IP: Loopback(dst.Addr()), Port: dst.Port()}
+}
+
+// Loopback returns the agent-side loopback address of the same family as
+// addr.
+func Loopback(addr netip.Addr) []byte {
+	if addr.Is6() {
+		return net.IPv6loopback
+	}
+	return []byte{127, 0, 0, 1}
+}
+
+func parseTarget(s string) (target, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	keepPort := false
+	port := 0
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		keepPort = true
+	} else {
+		port, err = strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			return target{}, fmt.Errorf("bad port %q", portStr)
+		}
+	}
+	if host == "" {
+		return target{}, fmt.Errorf("empty host")
+	}
+
+	t := target{Target: Target{Port: uint16(port)}, keepPort: keepPort}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		t.IP = addr.Unmap().AsSlice()
+	} else {
+		t.Host = host
+	}
+	return t, nil
+}
+
+func unmap(addrPort netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
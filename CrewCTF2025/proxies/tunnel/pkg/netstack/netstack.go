@@ -9,6 +9,7 @@ import (
 	"sync"
 
 	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/routing"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
 	"gvisor.dev/gvisor/pkg/buffer"
@@ -16,8 +17,11 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
 
 var (
@@ -26,14 +30,16 @@ var (
 )
 
 type NetStack struct {
-	ClientName string
-	Ustack     *stack.Stack
-	NicID      tcpip.NICID
-	Dev        tun.Device
-	LinkEP     *channel.Endpoint
+	Routes *routing.Table
+	Ustack *stack.Stack
+	NicID  tcpip.NICID
+	Dev    tun.Device
+	LinkEP *channel.Endpoint
 }
 
-func New(name string, clientName string) (*NetStack, error) {
+// New creates the TUN device name and its stack. Flows are sent to the agent
+// that routes picks for their destination.
+func New(name string, routes *routing.Table) (*NetStack, error) {
 
 	netstacksMu.Lock()
 	if ns, exists := netstacks[name]; exists {
@@ -43,8 +49,8 @@ func New(name string, clientName string) (*NetStack, error) {
 	netstacksMu.Unlock()
 
 	ustack := stack.New(stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
-		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
 	})
 
 	slog.Info("Setting up TUN device with parameters", slog.Int("mtu", config.MTU))
@@ -85,14 +91,30 @@ func New(name string, clientName string) (*NetStack, error) {
 		Destination: ipv4Subnet,
 		NIC:         nicID,
 	})
+
+	_, ip6net, err := net.ParseCIDR(config.LocalIPv6CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse IPv6 subnet: %s", err)
+	}
+	ipv6Subnet, err := tcpip.NewSubnet(
+		tcpip.AddrFromSlice(ip6net.IP.To16()),
+		tcpip.MaskFromBytes(ip6net.Mask),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IPv6 subnet: %s", err)
+	}
+	tcpRoute = append(tcpRoute, tcpip.Route{
+		Destination: ipv6Subnet,
+		NIC:         nicID,
+	})
 	ustack.SetRouteTable(tcpRoute)
 
 	nstack := &NetStack{
-		ClientName: clientName,
-		Ustack:     ustack,
-		NicID:      nicID,
-		Dev:        dev,
-		LinkEP:     linkEP,
+		Routes: routes,
+		Ustack: ustack,
+		NicID:  nicID,
+		Dev:    dev,
+		LinkEP: linkEP,
 	}
 
 	netstacksMu.Lock()
@@ -115,18 +137,27 @@ func ForwardEndpointToTunnel(ctx context.Context, endpoint *channel.Endpoint, tu
 		buf := packet.ToBuffer()
 		bytes := (&buf).Flatten()
 		// log.Printf("DEBUG: Forward to Tunnel buf: %x\n", bytes)
-		const writeOffset = device.MessageTransportHeaderSize
-		moreBytes := make([]byte, writeOffset, len(bytes)+writeOffset)
-		moreBytes = append(moreBytes[:writeOffset], bytes...)
-
-		if _, err := tun.Write([][]byte{moreBytes}, writeOffset); err != nil {
+		if err := WritePacket(tun, bytes); err != nil {
 			slog.Error("failed to inject inbound", "error", err)
 			return
 		}
 	}
 }
 
-func ForwardTunnelToEndpoint(ctx context.Context, tun tun.Device, dstEndpoint *channel.Endpoint) error {
+// WritePacket writes one raw IP packet to the TUN device.
+func WritePacket(tun tun.Device, packet []byte) error {
+	const writeOffset = device.MessageTransportHeaderSize
+	moreBytes := make([]byte, writeOffset, len(packet)+writeOffset)
+	moreBytes = append(moreBytes[:writeOffset], packet...)
+
+	_, err := tun.Write([][]byte{moreBytes}, writeOffset)
+	return err
+}
+
+// ForwardTunnelToEndpoint feeds packets read from the TUN device into the
+// stack. Packets for which intercept returns true are handled outside the
+// stack and not injected.
+func ForwardTunnelToEndpoint(ctx context.Context, tun tun.Device, dstEndpoint *channel.Endpoint, intercept func(packet []byte) bool) error {
 	buffers := make([][]byte, tun.BatchSize())
 	for i := range buffers {
 		buffers[i] = make([]byte, device.MaxMessageSize)
@@ -144,11 +175,24 @@ func ForwardTunnelToEndpoint(ctx context.Context, tun tun.Device, dstEndpoint *c
 		}
 		for i := range sizes[:n] {
 			buffers[i] = buffers[i][readOffset : readOffset+sizes[i]]
+			if intercept != nil && intercept(buffers[i]) {
+				continue
+			}
 			// ready to send data to channel
+			var proto tcpip.NetworkProtocolNumber
+			switch header.IPVersion(buffers[i]) {
+			case header.IPv4Version:
+				proto = header.IPv4ProtocolNumber
+			case header.IPv6Version:
+				proto = header.IPv6ProtocolNumber
+			default:
+				slog.Debug("dropping packet with unknown IP version")
+				continue
+			}
 			packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
 				Payload: buffer.MakeWithData(bytes.Clone(buffers[i])),
 			})
-			dstEndpoint.InjectInbound(header.IPv4ProtocolNumber, packetBuf)
+			dstEndpoint.InjectInbound(proto, packetBuf)
 			packetBuf.DecRef()
 		}
 	}
@@ -0,0 +1,275 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// maxMessage is the largest Noise message, the length prefix is 16 bits.
+	maxMessage = 65535
+	tagSize    = 16
+	maxPayload = maxMessage - tagSize
+)
+
+// Conn is a connection secured by Noise. The handshake runs on the first
+// Read or Write, or on an explicit Handshake call.
+type Conn struct {
+	net.Conn
+
+	initiator bool
+	static    KeyPair
+	// remote is the peer's static key: known in advance by the initiator,
+	// learnt from the handshake by the responder.
+	remote Key
+	allow  func(Key) bool
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+
+	readMu  sync.Mutex
+	recv    *cipherState
+	pending []byte
+
+	writeMu sync.Mutex
+	send    *cipherState
+}
+
+// Client secures conn as the initiator, which has to know the responder's
+// static key.
+func Client(conn net.Conn, static KeyPair, remote Key) *Conn {
+	return &Conn{Conn: conn, initiator: true, static: static, remote: remote}
+}
+
+// Server secures conn as the responder. allow decides whether the
+// initiator's static key is accepted.
+func Server(conn net.Conn, static KeyPair, allow func(Key) bool) *Conn {
+	return &Conn{Conn: conn, static: static, allow: allow}
+}
+
+// PeerKey returns the static key of the peer once the handshake succeeded.
+func (c *Conn) PeerKey() Key {
+	return c.remote
+}
+
+// Handshake runs the IK handshake if it has not run yet.
+func (c *Conn) Handshake() error {
+	c.handshakeOnce.Do(func() {
+		if c.initiator {
+			c.handshakeErr = c.clientHandshake()
+		} else {
+			c.handshakeErr = c.serverHandshake()
+		}
+	})
+	return c.handshakeErr
+}
+
+// -> e, es, s, ss
+// <- e, ee, se
+func (c *Conn) clientHandshake() error {
+	ss := newSymmetricState()
+	ss.mixHash(c.remote[:])
+
+	e, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	msg := append([]byte{}, e.Public[:]...)
+	ss.mixHash(e.Public[:])
+	if err := mixDH(ss, e, c.remote); err != nil {
+		return err
+	}
+	encStatic, err := ss.encryptAndHash(c.static.Public[:])
+	if err != nil {
+		return err
+	}
+	msg = append(msg, encStatic...)
+	if err := mixDH(ss, c.static, c.remote); err != nil {
+		return err
+	}
+	payload, err := ss.encryptAndHash(nil)
+	if err != nil {
+		return err
+	}
+	msg = append(msg, payload...)
+	if err := writeMessage(c.Conn, msg); err != nil {
+		return err
+	}
+
+	msg, err = readMessage(c.Conn)
+	if err != nil {
+		return err
+	}
+	if len(msg) != len(Key{})+tagSize {
+		return fmt.Errorf("noise: bad handshake response length %d", len(msg))
+	}
+	var re Key
+	copy(re[:], msg)
+	ss.mixHash(re[:])
+	if err := mixDH(ss, e, re); err != nil {
+		return err
+	}
+	if err := mixDH(ss, c.static, re); err != nil {
+		return err
+	}
+	if _, err := ss.decryptAndHash(msg[len(re):]); err != nil {
+		return err
+	}
+	c.send, c.recv = ss.split()
+	return nil
+}
+
+func (c *Conn) serverHandshake() error {
+	ss := newSymmetricState()
+	ss.mixHash(c.static.Public[:])
+
+	msg, err := readMessage(c.Conn)
+	if err != nil {
+		return err
+	}
+	if len(msg) != len(Key{})+len(Key{})+tagSize+tagSize {
+		return fmt.Errorf("noise: bad handshake length %d", len(msg))
+	}
+	var re Key
+	copy(re[:], msg)
+	msg = msg[len(re):]
+	ss.mixHash(re[:])
+	if err := mixDH(ss, c.static, re); err != nil {
+		return err
+	}
+	rs, err := ss.decryptAndHash(msg[:len(Key{})+tagSize])
+	if err != nil {
+		return err
+	}
+	msg = msg[len(Key{})+tagSize:]
+	copy(c.remote[:], rs)
+	if err := mixDH(ss, c.static, c.remote); err != nil {
+		return err
+	}
+	if _, err := ss.decryptAndHash(msg); err != nil {
+		return err
+	}
+	if c.allow != nil && !c.allow(c.remote) {
+		return fmt.Errorf("%w: %s", ErrPeerRejected, c.remote)
+	}
+
+	e, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	reply := append([]byte{}, e.Public[:]...)
+	ss.mixHash(e.Public[:])
+	if err := mixDH(ss, e, re); err != nil {
+		return err
+	}
+	if err := mixDH(ss, e, c.remote); err != nil {
+		return err
+	}
+	payload, err := ss.encryptAndHash(nil)
+	if err != nil {
+		return err
+	}
+	reply = append(reply, payload...)
+	if err := writeMessage(c.Conn, reply); err != nil {
+		return err
+	}
+	c.recv, c.send = ss.split()
+	return nil
+}
+
+func mixDH(ss *symmetricState, kp KeyPair, pub Key) error {
+	shared, err := dh(kp, pub)
+	if err != nil {
+		return err
+	}
+	ss.mixKey(shared)
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		msg, err := readMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.pending, err = c.recv.decrypt(nil, msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		n := min(len(b)-written, maxPayload)
+		msg, err := c.send.encrypt(nil, b[written:written+n])
+		if err != nil {
+			return written, err
+		}
+		if err := writeMessage(c.Conn, msg); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func readMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// Listener secures every accepted connection as a Noise responder.
+type Listener struct {
+	net.Listener
+	static KeyPair
+	allow  func(Key) bool
+}
+
+func NewListener(ln net.Listener, static KeyPair, allow func(Key) bool) *Listener {
+	return &Listener{Listener: ln, static: static, allow: allow}
+}
+
+// Accept returns the next connection, its handshake runs on first use.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.static, l.allow), nil
+}
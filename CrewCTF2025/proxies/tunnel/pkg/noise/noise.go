@@ -0,0 +1,206 @@
+// Package noise secures a connection with the Noise IK handshake
+// (Noise_IK_25519_ChaChaPoly_BLAKE2s): the initiator knows the responder's
+// static key beforehand and both ends are authenticated by their static
+// Curve25519 keys, without certificates.
+package noise
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const protocolName = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+
+var (
+	ErrDecrypt       = errors.New("noise: message authentication failed")
+	ErrPeerRejected  = errors.New("noise: peer key not allowed")
+	ErrNonceOverflow = errors.New("noise: nonce exhausted")
+)
+
+// random is where keys come from, replaced by tests for fixed ephemeral keys.
+var random io.Reader = rand.Reader
+
+// Key is a Curve25519 key.
+type Key [32]byte
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParseKey decodes a base64 key, as printed by Key.String.
+func ParseKey(s string) (Key, error) {
+	var k Key
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return k, fmt.Errorf("bad key: %w", err)
+	}
+	if len(b) != len(k) {
+		return k, fmt.Errorf("bad key length %d", len(b))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// KeyPair is a static or ephemeral Curve25519 key pair.
+type KeyPair struct {
+	Private Key
+	Public  Key
+}
+
+func GenerateKeyPair() (KeyPair, error) {
+	var kp KeyPair
+	if _, err := io.ReadFull(random, kp.Private[:]); err != nil {
+		return kp, err
+	}
+	return NewKeyPair(kp.Private)
+}
+
+// NewKeyPair derives the public key of private.
+func NewKeyPair(private Key) (KeyPair, error) {
+	pub, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	kp := KeyPair{Private: private}
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+func dh(kp KeyPair, pub Key) ([]byte, error) {
+	return curve25519.X25519(kp.Private[:], pub[:])
+}
+
+// cipherState encrypts with a key and an incrementing nonce.
+type cipherState struct {
+	key   [32]byte
+	nonce uint64
+	set   bool
+}
+
+func (c *cipherState) nonceBytes() []byte {
+	var n [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(n[4:], c.nonce)
+	return n[:]
+}
+
+func (c *cipherState) encrypt(ad, plaintext []byte) ([]byte, error) {
+	if !c.set {
+		return plaintext, nil
+	}
+	if c.nonce == ^uint64(0) {
+		return nil, ErrNonceOverflow
+	}
+	aead, err := chacha20poly1305.New(c.key[:])
+	if err != nil {
+		return nil, err
+	}
+	out := aead.Seal(nil, c.nonceBytes(), plaintext, ad)
+	c.nonce++
+	return out, nil
+}
+
+func (c *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if !c.set {
+		return ciphertext, nil
+	}
+	if c.nonce == ^uint64(0) {
+		return nil, ErrNonceOverflow
+	}
+	aead, err := chacha20poly1305.New(c.key[:])
+	if err != nil {
+		return nil, err
+	}
+	out, err := aead.Open(nil, c.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	c.nonce++
+	return out, nil
+}
+
+// symmetricState is the chaining key and handshake hash of the handshake.
+type symmetricState struct {
+	cs cipherState
+	ck [32]byte
+	h  [32]byte
+}
+
+func newSymmetricState() *symmetricState {
+	s := &symmetricState{}
+	s.h = blake2s.Sum256([]byte(protocolName))
+	s.ck = s.h
+	// Empty prologue
+	s.mixHash(nil)
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h, _ := blake2s.New256(nil)
+	h.Write(s.h[:])
+	h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	var k [32]byte
+	hkdf(s.ck[:], ikm, s.ck[:], k[:])
+	s.cs = cipherState{key: k, set: true}
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	out, err := s.cs.encrypt(s.h[:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(out)
+	return out, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	out, err := s.cs.decrypt(s.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return out, nil
+}
+
+// split returns the cipher states of the transport phase, initiator to
+// responder first.
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	var k1, k2 [32]byte
+	hkdf(s.ck[:], nil, k1[:], k2[:])
+	return &cipherState{key: k1, set: true}, &cipherState{key: k2, set: true}
+}
+
+func newHash() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func hmacSum(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(newHash, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// hkdf is the Noise HKDF with two outputs.
+func hkdf(ck, ikm []byte, out1, out2 []byte) {
+	temp := hmacSum(ck, ikm)
+	o1 := hmacSum(temp, []byte{1})
+	o2 := hmacSum(temp, o1, []byte{2})
+	copy(out1, o1)
+	copy(out2, o2)
+}
@@ -0,0 +1,246 @@
+package noise
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordConn keeps the messages written to a connection, without their
+// length prefix, and can corrupt one of them.
+type recordConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes [][]byte
+	// tamper, when set, flips a bit in the message with this index
+	tamper int
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	msg := bytes.Clone(b)
+	if c.tamper == len(c.writes)+1 {
+		msg[len(msg)-1] ^= 1
+	}
+	c.writes = append(c.writes, msg[2:])
+	c.mu.Unlock()
+	return c.Conn.Write(msg)
+}
+
+func (c *recordConn) messages() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func keyPair(t *testing.T, private string) KeyPair {
+	t.Helper()
+	var k Key
+	copy(k[:], mustDecode(t, private))
+	kp, err := NewKeyPair(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+func generate(t *testing.T) KeyPair {
+	t.Helper()
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+// pair returns the two ends of a handshake between fresh keys, the
+// responder accepting any initiator.
+func pair(t *testing.T) (client, server *Conn) {
+	t.Helper()
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	serverKey := generate(t)
+	return Client(c, generate(t), serverKey.Public), Server(s, serverKey, nil)
+}
+
+// handshake runs both ends of a handshake, returning their errors.
+func handshake(client, server *Conn) (clientErr, serverErr error) {
+	done := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			server.Close()
+		}
+		done <- err
+	}()
+	clientErr = client.Handshake()
+	if clientErr != nil {
+		client.Close()
+	}
+	return clientErr, <-done
+}
+
+// The Noise_IK_25519_ChaChaPoly_BLAKE2s vector without prologue nor
+// handshake payloads, from the vectors.txt of github.com/flynn/noise in the
+// cacophony format.
+func TestVector(t *testing.T) {
+	initStatic := keyPair(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	respStatic := keyPair(t, "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20")
+	ephemerals := "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f" +
+		"4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60"
+	want := []string{
+		"358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254c9f0dff42c86abe5677abe74f6c87301577dbc1f3ffb2213827ca694a057fdbbff7f7350265fe61102c24d7d7a7e960ba8b90a679895087c7d28b1d6703f9727",
+		"64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d4846622bf9c6171ddd4c8f682080b03504eee",
+		"595694f9be48f03790f699455c84578b31d14a7baedfd736d73c53f66a5657",
+		"621ae446b11fda3cf08e56102dac9324dee37a4e536cdc878e8b454d98bcf2",
+	}
+
+	// The initiator's ephemeral key is generated first, the responder's
+	// once it read the first message
+	defer func(r io.Reader) { random = r }(random)
+	random = bytes.NewReader(mustDecode(t, ephemerals))
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	crec, srec := &recordConn{Conn: c}, &recordConn{Conn: s}
+	client := Client(crec, initStatic, respStatic.Public)
+	server := Server(srec, respStatic, func(k Key) bool { return k == initStatic.Public })
+	if cerr, serr := handshake(client, server); cerr != nil || serr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", cerr, serr)
+	}
+
+	exchange := func(from, to *Conn, payload string) {
+		t.Helper()
+		go from.Write([]byte(payload))
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(to, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != payload {
+			t.Fatalf("got %q, want %q", got, payload)
+		}
+	}
+	exchange(client, server, "yellowsubmarine")
+	exchange(server, client, "submarineyellow")
+
+	cmsgs, smsgs := crec.messages(), srec.messages()
+	got := [][]byte{cmsgs[0], smsgs[0], cmsgs[1], smsgs[1]}
+	for i := range want {
+		if hex.EncodeToString(got[i]) != want[i] {
+			t.Errorf("message %d: got %x, want %s", i, got[i], want[i])
+		}
+	}
+	if server.PeerKey() != initStatic.Public {
+		t.Errorf("server learnt key %s, want %s", server.PeerKey(), initStatic.Public)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	client, server := pair(t)
+	// Larger than a message, both ways at once
+	data := make([]byte, 3*maxPayload+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	errc := make(chan error, 2)
+	for _, conn := range []*Conn{client, server} {
+		go func() {
+			_, err := conn.Write(data)
+			errc <- err
+		}()
+	}
+	for _, conn := range []*Conn{client, server} {
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data changed on the way")
+		}
+	}
+	for range 2 {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if server.PeerKey() != client.static.Public {
+		t.Errorf("server learnt key %s, want %s", server.PeerKey(), client.static.Public)
+	}
+}
+
+func TestTamperedCiphertext(t *testing.T) {
+	tests := []struct {
+		name    string
+		message int
+	}{
+		{"handshake", 1},
+		{"transport", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			serverKey := generate(t)
+			client := Client(&recordConn{Conn: c, tamper: tt.message}, generate(t), serverKey.Public)
+			server := Server(s, serverKey, nil)
+
+			go client.Write([]byte("hello"))
+			_, err := server.Read(make([]byte, 5))
+			if !errors.Is(err, ErrDecrypt) {
+				t.Fatalf("got error %v, want %v", err, ErrDecrypt)
+			}
+		})
+	}
+}
+
+func TestUnknownStaticKey(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	serverKey, allowed := generate(t), generate(t)
+	client := Client(c, generate(t), serverKey.Public)
+	server := Server(s, serverKey, func(k Key) bool { return k == allowed.Public })
+
+	cerr, serr := handshake(client, server)
+	if !errors.Is(serr, ErrPeerRejected) {
+		t.Errorf("server got error %v, want %v", serr, ErrPeerRejected)
+	}
+	if cerr == nil {
+		t.Error("client handshake succeeded with a rejected key")
+	}
+}
+
+func TestWrongResponderKey(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	// The initiator pins another key than the responder's
+	client := Client(c, generate(t), generate(t).Public)
+	server := Server(s, generate(t), nil)
+
+	cerr, serr := handshake(client, server)
+	if !errors.Is(serr, ErrDecrypt) {
+		t.Errorf("server got error %v, want %v", serr, ErrDecrypt)
+	}
+	if cerr == nil {
+		t.Error("client handshake succeeded with the wrong responder key")
+	}
+}
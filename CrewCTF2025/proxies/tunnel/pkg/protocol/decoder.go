@@ -8,12 +8,19 @@ import (
 )
 
 type Decoder struct {
-	reader  io.Reader
-	Payload interface{}
+	reader       io.Reader
+	maxFrameSize int
+	Payload      interface{}
+	Flags        uint8
 }
 
 func NewDecoder(reader io.Reader) *Decoder {
-	return &Decoder{reader: reader}
+	return &Decoder{reader: reader, maxFrameSize: DefaultMaxFrameSize}
+}
+
+// SetMaxFrameSize limits the body size of frames this decoder will accept.
+func (d *Decoder) SetMaxFrameSize(size int) {
+	d.maxFrameSize = size
 }
 
 func typeToStruct(payloadType uint8) (interface{}, error) {
@@ -28,26 +35,62 @@ func typeToStruct(payloadType uint8) (interface{}, error) {
 		return &DataPacket{}, nil
 	case MessagePingRequest:
 		return &PingRequest{}, nil
+	case MessageWindowUpdate:
+		return &WindowUpdate{}, nil
+	case MessageCloseWrite:
+		return &CloseWriteRequest{}, nil
+	case MessageReset:
+		return &ResetRequest{}, nil
+	case MessageDatagram:
+		return &Datagram{}, nil
+	case MessageDatagramClose:
+		return &DatagramClose{}, nil
+	case MessageEchoRequest:
+		return &EchoRequest{}, nil
+	case MessageEchoReply:
+		return &EchoReply{}, nil
+	case MessageResumeState:
+		return &ResumeState{}, nil
+	case MessageListenRequest:
+		return &ListenRequest{}, nil
+	case MessageListenResponse:
+		return &ListenResponse{}, nil
+	case MessageForwardRequest:
+		return &ForwardRequest{}, nil
+	case MessageForwardResponse:
+		return &ForwardResponse{}, nil
 	default:
-		return nil, fmt.Errorf("unknown payload type: %d", payloadType)
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMessage, payloadType)
 	}
 }
 
+// Decode reads the next frame into Payload. A frame with an unknown message
+// type is consumed and reported with ErrUnknownMessage, so the caller may keep
+// decoding. Any other error leaves the stream unusable.
 func (d *Decoder) Decode() error {
-	var payloadType uint8
-	if err := msgpack.UnmarshalRead(d.reader, &payloadType); err != nil {
+	header, err := readFrameHeader(d.reader)
+	if err != nil {
+		return err
+	}
+	if int64(header.Length) > int64(d.maxFrameSize) {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, header.Length)
+	}
+
+	body := make([]byte, header.Length)
+	if _, err := io.ReadFull(d.reader, body); err != nil {
 		return err
 	}
 
-	obj, err := typeToStruct(payloadType)
+	obj, err := typeToStruct(header.Type)
 	if err != nil {
 		return err
 	}
 
-	if err := msgpack.UnmarshalRead(d.reader, obj); err != nil {
+	if err := msgpack.Unmarshal(body, obj); err != nil {
 		return err
 	}
 
 	d.Payload = obj
+	d.Flags = header.Flags
 	return nil
 }
@@ -8,11 +8,17 @@ import (
 )
 
 type Encoder struct {
-	writer io.Writer
+	writer       io.Writer
+	maxFrameSize int
 }
 
 func NewEncoder(writer io.Writer) *Encoder {
-	return &Encoder{writer: writer}
+	return &Encoder{writer: writer, maxFrameSize: DefaultMaxFrameSize}
+}
+
+// SetMaxFrameSize limits the body size of frames this encoder will write.
+func (e *Encoder) SetMaxFrameSize(size int) {
+	e.maxFrameSize = size
 }
 
 func typeForPayload(payload interface{}) (uint8, error) {
@@ -27,6 +33,30 @@ func typeForPayload(payload interface{}) (uint8, error) {
 		return MessageDataPacket, nil
 	case PingRequest:
 		return MessagePingRequest, nil
+	case WindowUpdate:
+		return MessageWindowUpdate, nil
+	case CloseWriteRequest:
+		return MessageCloseWrite, nil
+	case ResetRequest:
+		return MessageReset, nil
+	case Datagram:
+		return MessageDatagram, nil
+	case DatagramClose:
+		return MessageDatagramClose, nil
+	case EchoRequest:
+		return MessageEchoRequest, nil
+	case EchoReply:
+		return MessageEchoReply, nil
+	case ResumeState:
+		return MessageResumeState, nil
+	case ListenRequest:
+		return MessageListenRequest, nil
+	case ListenResponse:
+		return MessageListenResponse, nil
+	case ForwardRequest:
+		return MessageForwardRequest, nil
+	case ForwardResponse:
+		return MessageForwardResponse, nil
 	default:
 		return 0, fmt.Errorf("unknown payload type: %T", payload)
 	}
@@ -37,13 +67,20 @@ func (e *Encoder) Encode(payload interface{}) error {
 	if err != nil {
 		return err
 	}
-	// Write type byte
-	if err := msgpack.MarshalWrite(e.writer, payloadType); err != nil {
+	body, err := msgpack.Marshal(payload)
+	if err != nil {
 		return err
 	}
-	// Write payload
-	if err := msgpack.MarshalWrite(e.writer, payload); err != nil {
-		return err
+	if len(body) > e.maxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(body))
+	}
+	header := frameHeader{
+		Version: ProtocolVersion,
+		Type:    payloadType,
+		Length:  uint32(len(body)),
 	}
-	return nil
+	// Write header and body in a single call so a frame is never split
+	// across writes
+	_, err = e.writer.Write(append(header.marshal(), body...))
+	return err
 }
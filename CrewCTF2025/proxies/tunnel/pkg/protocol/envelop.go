@@ -1,31 +1,137 @@
 package protocol
 
+// ConnectRequest asks the agent to open a TCP connection. Host, when set, is
+// resolved by the agent and takes the place of IP.
 type ConnectRequest struct {
 	IP   []byte
+	Host string
 	Port uint16
 	ID   uint32
 }
 
 type ConnectResponse struct {
-	Ok bool
-	ID uint32
+	Ok    bool
+	ID    uint32
+	ReqID uint32
 }
 
 type CloseRequest struct {
 	ID uint32
 }
 
+// CloseWriteRequest tells the peer that no more data will be sent on the
+// stream. The other direction stays open.
+type CloseWriteRequest struct {
+	ID uint32
+}
+
+// ResetRequest aborts a stream, the peer resets its side of the connection.
+type ResetRequest struct {
+	ID uint32
+}
+
 type DataPacket struct {
 	ID   uint32
 	Data []byte
 }
 
+// Datagram carries one UDP payload of a session. IP (or Host) and Port name
+// the target the agent should send it to, the agent opens a socket for a
+// session the first time it sees its ID.
+type Datagram struct {
+	ID   uint32
+	IP   []byte
+	Host string
+	Port uint16
+	Data []byte
+}
+
+// DatagramClose ends a UDP session.
+type DatagramClose struct {
+	ID uint32
+}
+
+// EchoRequest asks the agent to ping IP (or Host) with an ICMP echo carrying
+// Data.
+type EchoRequest struct {
+	ID   uint32
+	IP   []byte
+	Host string
+	Data []byte
+}
+
+// EchoReply answers the EchoRequest with the same ID. Ok is false when the
+// target did not answer in time.
+type EchoReply struct {
+	ID uint32
+	Ok bool
+}
+
+// ResumeState is the first message each end sends on a connection resuming a
+// session. It lists the streams the sender still holds with the number of
+// bytes it received and consumed on each, so the peer can replay what was
+// lost and recompute its send window.
+type ResumeState struct {
+	Streams []StreamState
+}
+
+type StreamState struct {
+	ID       uint32
+	Received uint64
+	Consumed uint64
+}
+
+// ListenRequest asks the agent to listen on Addr for the remote forward ID.
+// The agent carries every connection it accepts there back to the proxy with
+// a ForwardRequest.
+type ListenRequest struct {
+	ID   uint32
+	Addr string
+}
+
+// ListenResponse tells whether the agent listens for the remote forward ID.
+type ListenResponse struct {
+	ID uint32
+	Ok bool
+}
+
+// ForwardRequest is sent by the agent for a connection accepted by the
+// listener of the remote forward ListenID. The agent picks the stream ID.
+type ForwardRequest struct {
+	ID       uint32
+	ListenID uint32
+}
+
+// ForwardResponse answers the ForwardRequest of stream ID. Ok means the proxy
+// connected to the forward's target and the stream is open.
+type ForwardResponse struct {
+	ID uint32
+	Ok bool
+}
+
 type PingRequest struct{}
 
+type WindowUpdate struct {
+	ID        uint32
+	Increment uint32
+}
+
 const (
 	MessageConnectRequest  = uint8(1)
 	MessageConnectResponse = uint8(2)
 	MessageCloseRequest    = uint8(3)
 	MessageDataPacket      = uint8(4)
 	MessagePingRequest     = uint8(5)
+	MessageWindowUpdate    = uint8(6)
+	MessageCloseWrite      = uint8(7)
+	MessageReset           = uint8(8)
+	MessageDatagram        = uint8(9)
+	MessageDatagramClose   = uint8(10)
+	MessageEchoRequest     = uint8(11)
+	MessageEchoReply       = uint8(12)
+	MessageResumeState     = uint8(13)
+	MessageListenRequest   = uint8(14)
+	MessageListenResponse  = uint8(15)
+	MessageForwardRequest  = uint8(16)
+	MessageForwardResponse = uint8(17)
 )
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message on the agent link is sent as one frame:
+//
+//	magic (2) | version (1) | type (1) | flags (1) | length (4, big endian) | body
+//
+// The body is the msgpack encoding of the message. The length lets a decoder
+// skip message types it does not know yet.
+const (
+	FrameMagic          = uint16(0x544e)
+	ProtocolVersion     = uint8(1)
+	FrameHeaderSize     = 9
+	DefaultMaxFrameSize = 256 * 1024
+)
+
+var (
+	ErrBadMagic           = errors.New("bad frame magic")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrFrameTooLarge      = errors.New("frame too large")
+	ErrUnknownMessage     = errors.New("unknown message type")
+)
+
+type frameHeader struct {
+	Version uint8
+	Type    uint8
+	Flags   uint8
+	Length  uint32
+}
+
+func (h frameHeader) marshal() []byte {
+	buf := make([]byte, FrameHeaderSize)
+	binary.BigEndian.PutUint16(buf[0:2], FrameMagic)
+	buf[2] = h.Version
+	buf[3] = h.Type
+	buf[4] = h.Flags
+	binary.BigEndian.PutUint32(buf[5:9], h.Length)
+	return buf
+}
+
+func readFrameHeader(reader io.Reader) (frameHeader, error) {
+	var buf [FrameHeaderSize]byte
+	if _, err := io.ReadFull(reader, buf[:]); err != nil {
+		return frameHeader{}, err
+	}
+	if magic := binary.BigEndian.Uint16(buf[0:2]); magic != FrameMagic {
+		return frameHeader{}, fmt.Errorf("%w: %#04x", ErrBadMagic, magic)
+	}
+	h := frameHeader{
+		Version: buf[2],
+		Type:    buf[3],
+		Flags:   buf[4],
+		Length:  binary.BigEndian.Uint32(buf[5:9]),
+	}
+	if h.Version != ProtocolVersion {
+		return frameHeader{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	return h, nil
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type lingerer interface {
+	SetLinger(sec int) error
+}
+
+// Pipe copies data between conn and stream in both directions. An EOF on one
+// side is passed on as a half-close, and a reset on one side resets the other.
+// It returns once both directions are done or either one failed, closing conn
+// and stream.
+func Pipe(conn net.Conn, stream *Stream) error {
+	errc := make(chan error, 2)
+	go func() { errc <- connToStream(conn, stream) }()
+	go func() { errc <- streamToConn(stream, conn) }()
+
+	var err error
+	for range 2 {
+		if err = <-errc; err != nil {
+			break
+		}
+	}
+	conn.Close()
+	stream.Close()
+	return err
+}
+
+func connToStream(conn net.Conn, stream *Stream) error {
+	buf := make([]byte, MaxDataChunk)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, werr := stream.Write(buf[:n]); werr != nil {
+				if errors.Is(werr, ErrStreamReset) {
+					resetConn(conn)
+				}
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return stream.CloseWrite()
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				stream.Reset()
+			}
+			return err
+		}
+	}
+}
+
+func streamToConn(stream *Stream, conn net.Conn) error {
+	buf := make([]byte, MaxDataChunk)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				stream.Reset()
+				return werr
+			}
+		}
+		if err == io.EOF {
+			if cw, ok := conn.(closeWriter); ok {
+				return cw.CloseWrite()
+			}
+			return conn.Close()
+		}
+		if err != nil {
+			if errors.Is(err, ErrStreamReset) {
+				resetConn(conn)
+			}
+			return err
+		}
+	}
+}
+
+// resetConn closes conn with an RST instead of a FIN where supported.
+func resetConn(conn net.Conn) {
+	if l, ok := conn.(lingerer); ok {
+		l.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -1,53 +1,197 @@
 package protocol
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
+	"io"
+	"sync"
 )
 
-func SendConnectRequest(conn net.Conn, ip []byte, port uint16, id uint32) error {
-	enc := NewEncoder(conn)
+// Sender is the single writer for one session. Every outbound message goes
+// through it so that frames written from different goroutines never
+// interleave on the wire. A sender outlives the connection it writes to when
+// the session is resumed, see Pause and Attach.
+type Sender struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	enc  *Encoder
+
+	// While paused only the messages resuming the session are written, the
+	// others wait for the resumption to finish.
+	paused bool
+	// gen counts the connections the sender was attached to.
+	gen uint64
+	err error
+}
+
+func NewSender(writer io.Writer) *Sender {
+	s := &Sender{enc: NewEncoder(writer)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// SetMaxFrameSize limits the body size of frames this sender will write.
+func (s *Sender) SetMaxFrameSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.SetMaxFrameSize(size)
+}
+
+func (s *Sender) Send(payload interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.wait(); err != nil {
+		return err
+	}
+	return s.enc.Encode(payload)
+}
+
+// SendContext is Send, giving up on waiting for a paused sender once ctx is
+// done.
+func (s *Sender) SendContext(ctx context.Context, payload interface{}) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.paused && s.err == nil && ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.enc.Encode(payload)
+}
+
+// sendStream writes a message of a stream unless valid, called with the
+// sender locked, returns false. Stream messages survive a lost connection:
+// data is retained and the rest is reconciled when the session resumes, so
+// write errors are not reported, only a failed sender is.
+func (s *Sender) sendStream(payload interface{}, valid func() bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.wait(); err != nil {
+		return err
+	}
+	if valid != nil && !valid() {
+		return nil
+	}
+	if err := s.enc.Encode(payload); errors.Is(err, ErrFrameTooLarge) {
+		return err
+	}
+	return nil
+}
+
+// wait blocks while the sender is paused and returns the error it failed
+// with, if any. s.mu must be held.
+func (s *Sender) wait() error {
+	for s.paused && s.err == nil {
+		s.cond.Wait()
+	}
+	return s.err
+}
+
+func (s *Sender) SendConnectRequest(ctx context.Context, ip []byte, host string, port uint16, id uint32) error {
 	req := ConnectRequest{
 		IP:   ip,
+		Host: host,
 		Port: port,
 		ID:   id,
 	}
-	if err := enc.Encode(req); err != nil {
+	if err := s.SendContext(ctx, req); err != nil {
 		return fmt.Errorf("send connect request failed: %w", err)
 	}
 	return nil
 }
 
-func SendConnectResponse(conn net.Conn, ok bool, id uint32) error {
-	enc := NewEncoder(conn)
+func (s *Sender) SendConnectResponse(ok bool, id uint32, reqID uint32) error {
 	resp := ConnectResponse{
-		Ok: ok,
-		ID: id,
+		Ok:    ok,
+		ID:    id,
+		ReqID: reqID,
 	}
-	if err := enc.Encode(resp); err != nil {
+	if err := s.Send(resp); err != nil {
 		return fmt.Errorf("send connect response failed: %w", err)
 	}
 	return nil
 }
 
-func SendDataPacket(conn net.Conn, id uint32, data []byte) error {
-	enc := NewEncoder(conn)
+func (s *Sender) SendDataPacket(id uint32, data []byte) error {
 	packet := DataPacket{
 		ID:   id,
 		Data: data,
 	}
-	if err := enc.Encode(packet); err != nil {
+	if err := s.Send(packet); err != nil {
 		return fmt.Errorf("send data packet failed: %w", err)
 	}
 	return nil
 }
 
-func SendCloseRequest(conn net.Conn, id uint32) error {
-	enc := NewEncoder(conn)
-	return enc.Encode(CloseRequest{ID: id})
+func (s *Sender) SendCloseRequest(id uint32) error {
+	return s.Send(CloseRequest{ID: id})
+}
+
+func (s *Sender) SendCloseWriteRequest(id uint32) error {
+	return s.Send(CloseWriteRequest{ID: id})
+}
+
+func (s *Sender) SendResetRequest(id uint32) error {
+	return s.Send(ResetRequest{ID: id})
+}
+
+func (s *Sender) SendDatagram(id uint32, ip []byte, host string, port uint16, data []byte) error {
+	packet := Datagram{
+		ID:   id,
+		IP:   ip,
+		Host: host,
+		Port: port,
+		Data: data,
+	}
+	if err := s.Send(packet); err != nil {
+		return fmt.Errorf("send datagram failed: %w", err)
+	}
+	return nil
+}
+
+func (s *Sender) SendDatagramClose(id uint32) error {
+	return s.Send(DatagramClose{ID: id})
+}
+
+func (s *Sender) SendEchoRequest(ctx context.Context, id uint32, ip []byte, host string, data []byte) error {
+	return s.SendContext(ctx, EchoRequest{ID: id, IP: ip, Host: host, Data: data})
+}
+
+func (s *Sender) SendEchoReply(id uint32, ok bool) error {
+	return s.Send(EchoReply{ID: id, Ok: ok})
+}
+
+func (s *Sender) SendListenRequest(id uint32, addr string) error {
+	return s.Send(ListenRequest{ID: id, Addr: addr})
+}
+
+func (s *Sender) SendListenResponse(id uint32, ok bool) error {
+	return s.Send(ListenResponse{ID: id, Ok: ok})
+}
+
+func (s *Sender) SendForwardRequest(id uint32, listenID uint32) error {
+	return s.Send(ForwardRequest{ID: id, ListenID: listenID})
+}
+
+func (s *Sender) SendForwardResponse(id uint32, ok bool) error {
+	return s.Send(ForwardResponse{ID: id, Ok: ok})
+}
+
+func (s *Sender) SendPingRequest() error {
+	return s.Send(PingRequest{})
 }
 
-func SendPingRequest(conn net.Conn) error {
-	enc := NewEncoder(conn)
-	return enc.Encode(PingRequest{})
+func (s *Sender) SendWindowUpdate(id uint32, increment uint32) error {
+	return s.Send(WindowUpdate{ID: id, Increment: increment})
 }
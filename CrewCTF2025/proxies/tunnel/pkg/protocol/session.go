@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+var errReattached = errors.New("sender attached to another connection")
+
+// A session survives the loss of its connection: the sender is paused, the
+// streams are kept, and once both ends are connected again each sends a
+// ResumeState and replays what the other did not receive.
+//
+//	Pause ... Attach(newConn), SendResumeState ... ResumeStreams(peer state)
+
+// Pause holds back every message until the session is resumed on a new
+// connection or the sender fails.
+func (s *Sender) Pause() {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+}
+
+// Attach makes a paused sender write to a new connection. It stays paused
+// until ResumeStreams has replayed the streams.
+func (s *Sender) Attach(writer io.Writer) {
+	s.mu.Lock()
+	s.enc.writer = writer
+	s.gen++
+	s.mu.Unlock()
+}
+
+// Fail ends the session: pending and later messages fail with err.
+func (s *Sender) Fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// SendResumeState tells the peer which of the streams are still held and how
+// much of each was received, bypassing the pause.
+func (s *Sender) SendResumeState(streams []*Stream) error {
+	state := ResumeState{Streams: make([]StreamState, 0, len(streams))}
+	for _, stream := range streams {
+		state.Streams = append(state.Streams, stream.state())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(state)
+}
+
+// ResumeStreams brings streams in line with the state the peer sent after a
+// reconnection. Streams the peer no longer holds are closed and streams only
+// the peer holds are reset. It must be called from the read loop before any
+// later frame is handled; the replay runs in the background, the sender is
+// unpaused once it is done.
+func ResumeStreams(sender *Sender, streams []*Stream, peer *ResumeState) {
+	sender.mu.Lock()
+	gen, paused := sender.gen, sender.paused
+	sender.mu.Unlock()
+	if !paused {
+		slog.Warn("Ignoring ResumeState outside of a resumption")
+		return
+	}
+
+	remote := make(map[uint32]StreamState, len(peer.Streams))
+	for _, state := range peer.Streams {
+		remote[state.ID] = state
+	}
+	type replay struct {
+		id   uint32
+		data []byte
+		fin  bool
+	}
+	var replays []replay
+	for _, stream := range streams {
+		state, ok := remote[stream.ID]
+		delete(remote, stream.ID)
+		if !ok {
+			stream.CloseWithError(ErrStreamClosed)
+			continue
+		}
+		data, fin, ok := stream.resume(state)
+		if !ok {
+			slog.Error("Cannot resume stream", "ID", stream.ID, "received", state.Received)
+			stream.Reset()
+			continue
+		}
+		replays = append(replays, replay{id: stream.ID, data: data, fin: fin})
+	}
+
+	go func() {
+		for _, r := range replays {
+			for len(r.data) > 0 {
+				n := min(len(r.data), MaxDataChunk)
+				if err := sender.sendResume(gen, DataPacket{ID: r.id, Data: r.data[:n]}); err != nil {
+					return
+				}
+				r.data = r.data[n:]
+			}
+			if r.fin {
+				if err := sender.sendResume(gen, CloseWriteRequest{ID: r.id}); err != nil {
+					return
+				}
+			}
+		}
+		for id := range remote {
+			if err := sender.sendResume(gen, ResetRequest{ID: id}); err != nil {
+				return
+			}
+		}
+
+		sender.mu.Lock()
+		if sender.gen == gen {
+			sender.paused = false
+			sender.cond.Broadcast()
+		}
+		sender.mu.Unlock()
+	}()
+}
+
+// sendResume writes payload bypassing the pause, as long as the sender is
+// still attached to connection gen.
+func (s *Sender) sendResume(gen uint64, payload interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.gen != gen {
+		return errReattached
+	}
+	return s.enc.Encode(payload)
+}
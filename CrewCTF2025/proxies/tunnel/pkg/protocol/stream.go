@@ -0,0 +1,399 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// InitialWindowSize is the receive window both ends grant a stream when
+	// it is opened. A sender may have at most this many unacknowledged bytes
+	// in flight.
+	InitialWindowSize = 256 * 1024
+	// MaxDataChunk is the largest payload carried by a single DataPacket.
+	MaxDataChunk = 32 * 1024
+)
+
+var (
+	ErrStreamClosed   = errors.New("stream closed")
+	ErrStreamReset    = errors.New("stream reset by peer")
+	ErrWindowExceeded = errors.New("peer exceeded receive window")
+)
+
+// Stream is one end of a tunnelled connection. Incoming data is buffered up to
+// InitialWindowSize bytes and acknowledged with WindowUpdate messages as the
+// reader consumes it, so the read loop feeding a stream never blocks. Writes
+// pause once the peer's window is used up.
+type Stream struct {
+	ID uint32
+
+	sender  *Sender
+	onClose func(id uint32)
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	recvBuf     bytes.Buffer
+	recvUnacked int
+	recvTotal   uint64
+	recvErr     error
+	// ackEpoch changes when the receive state is reported in a ResumeState,
+	// window updates computed before that are dropped.
+	ackEpoch uint32
+
+	sendCredit int
+	sendErr    error
+	// sendBuf retains the data sent but not consumed by the peer yet,
+	// starting at stream offset sendAcked, to be replayed on resumption.
+	sendBuf      bytes.Buffer
+	sendAcked    uint64
+	sendTotal    uint64
+	peerConsumed uint64
+
+	finSent      bool
+	finRecv      bool
+	remoteClosed bool
+	closed       bool
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	// class is the protocol the stream carries, once known.
+	class string
+}
+
+// NewStream creates a stream whose outbound messages go through sender.
+// onClose is called once, when the stream is closed locally.
+func NewStream(id uint32, sender *Sender, onClose func(id uint32)) *Stream {
+	s := &Stream{
+		ID:         id,
+		sender:     sender,
+		onClose:    onClose,
+		sendCredit: InitialWindowSize,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.recvBuf.Len() == 0 && s.recvErr == nil && !s.closed && !s.readDeadline.expired() {
+		s.cond.Wait()
+	}
+	if s.closed {
+		s.mu.Unlock()
+		return 0, ErrStreamClosed
+	}
+	if s.recvBuf.Len() == 0 {
+		err := s.recvErr
+		if err == nil {
+			err = os.ErrDeadlineExceeded
+		}
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	n, _ := s.recvBuf.Read(p)
+	s.recvUnacked += n
+	var increment int
+	if s.recvUnacked >= InitialWindowSize/4 || s.recvBuf.Len() == 0 {
+		increment = s.recvUnacked
+		s.recvUnacked = 0
+	}
+	epoch := s.ackEpoch
+	s.mu.Unlock()
+
+	if increment > 0 {
+		update := WindowUpdate{ID: s.ID, Increment: uint32(increment)}
+		_ = s.sender.sendStream(update, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.ackEpoch == epoch
+		})
+	}
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.sendCredit == 0 && s.sendErr == nil && !s.closed && !s.finSent && !s.writeDeadline.expired() {
+			s.cond.Wait()
+		}
+		if s.closed || s.finSent {
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if s.sendErr != nil {
+			err := s.sendErr
+			s.mu.Unlock()
+			return written, err
+		}
+		if s.sendCredit == 0 {
+			s.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		n := min(len(p)-written, s.sendCredit, MaxDataChunk)
+		s.sendCredit -= n
+		s.sendTotal += uint64(n)
+		s.mu.Unlock()
+
+		chunk := p[written : written+n]
+		if err := s.sender.sendStream(DataPacket{ID: s.ID, Data: chunk}, func() bool {
+			return s.retain(chunk)
+		}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that no more data will be written. Data from the
+// peer can still be read.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.closed || s.finSent || s.sendErr != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	return s.sender.sendStream(CloseWriteRequest{ID: s.ID}, nil)
+}
+
+// Close tells the peer to tear the connection down and wakes up any pending
+// Read or Write. Nothing is sent if the peer is gone already or both sides
+// finished writing. It is safe to call more than once.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	notify := !s.remoteClosed && !(s.finSent && s.finRecv)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if s.onClose != nil {
+		s.onClose(s.ID)
+	}
+	if !notify {
+		return nil
+	}
+	return s.sender.sendStream(CloseRequest{ID: s.ID}, nil)
+}
+
+// Reset aborts the stream, the peer resets its side of the connection.
+func (s *Stream) Reset() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	notify := !s.remoteClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if s.onClose != nil {
+		s.onClose(s.ID)
+	}
+	if !notify {
+		return nil
+	}
+	return s.sender.sendStream(ResetRequest{ID: s.ID}, nil)
+}
+
+// SetDeadline sets the read and write deadlines, as for a net.Conn.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline makes a blocked or future Read fail with
+// os.ErrDeadlineExceeded once t has passed. A zero t means no deadline.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline.set(t, s.wake)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline makes a Write waiting for window fail with
+// os.ErrDeadlineExceeded once t has passed. A zero t means no deadline.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline.set(t, s.wake)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Stream) wake() {
+	s.mu.Lock()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// SetClass records the protocol the stream carries.
+func (s *Stream) SetClass(class string) {
+	s.mu.Lock()
+	s.class = class
+	s.mu.Unlock()
+}
+
+// Class returns the protocol the stream carries, empty until it is known.
+func (s *Stream) Class() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.class
+}
+
+// Deliver queues data received from the peer. It fails with
+// ErrWindowExceeded if the peer sent more than it was allowed to.
+func (s *Stream) Deliver(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.recvErr != nil {
+		return ErrStreamClosed
+	}
+	if s.recvBuf.Len()+s.recvUnacked+len(data) > InitialWindowSize {
+		return ErrWindowExceeded
+	}
+	s.recvBuf.Write(data)
+	s.recvTotal += uint64(len(data))
+	s.cond.Broadcast()
+	return nil
+}
+
+// AddCredit grows the send window after the peer consumed n bytes.
+func (s *Stream) AddCredit(n uint32) {
+	s.mu.Lock()
+	s.sendCredit += int(n)
+	s.peerConsumed += uint64(n)
+	s.trimSendBuf(s.peerConsumed)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// RemoteCloseWrite marks the end of the data sent by the peer. Read returns
+// io.EOF once the buffered data is consumed, writes are still allowed.
+func (s *Stream) RemoteCloseWrite() {
+	s.mu.Lock()
+	if s.recvErr == nil {
+		s.recvErr = io.EOF
+		s.finRecv = true
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// CloseWithError marks the stream as closed by the peer. Buffered data can
+// still be read, after which Read returns err. Writes fail immediately. A
+// reset (ErrStreamReset) discards buffered data.
+func (s *Stream) CloseWithError(err error) {
+	s.mu.Lock()
+	s.remoteClosed = true
+	if err == ErrStreamReset {
+		s.recvBuf.Reset()
+		s.recvErr = err
+		s.sendErr = err
+	}
+	if s.recvErr == nil {
+		s.recvErr = err
+	}
+	if s.sendErr == nil {
+		s.sendErr = ErrStreamClosed
+		if err != io.EOF {
+			s.sendErr = err
+		}
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// retain keeps a copy of data about to be sent, unless the stream is done
+// with sending already.
+func (s *Stream) retain(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.sendErr != nil {
+		return false
+	}
+	s.sendBuf.Write(data)
+	return true
+}
+
+// trimSendBuf drops retained data before stream offset off. s.mu must be
+// held.
+func (s *Stream) trimSendBuf(off uint64) {
+	if off <= s.sendAcked {
+		return
+	}
+	drop := min(off-s.sendAcked, uint64(s.sendBuf.Len()))
+	s.sendBuf.Next(int(drop))
+	s.sendAcked += drop
+}
+
+// state reports how much of the stream was received and consumed. Everything
+// consumed counts as acknowledged from now on.
+func (s *Stream) state() StreamState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackEpoch++
+	s.recvUnacked = 0
+	return StreamState{
+		ID:       s.ID,
+		Received: s.recvTotal,
+		Consumed: s.recvTotal - uint64(s.recvBuf.Len()),
+	}
+}
+
+// resume applies the state of the peer's end of the stream and returns the
+// data to send again, and whether the end of data has to be sent again. It
+// fails if the peer is missing data that is no longer retained.
+func (s *Stream) resume(peer StreamState) (data []byte, fin bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peer.Received < s.sendAcked || peer.Received > s.sendAcked+uint64(s.sendBuf.Len()) || peer.Consumed > peer.Received {
+		return nil, false, false
+	}
+	s.trimSendBuf(peer.Received)
+	s.peerConsumed = peer.Consumed
+	s.sendCredit = InitialWindowSize - int(s.sendTotal-peer.Consumed)
+	s.cond.Broadcast()
+	return bytes.Clone(s.sendBuf.Bytes()), s.finSent, true
+}
+
+// deadline is a Read or Write deadline of a stream, guarded by the stream's
+// mutex.
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+// set arms the deadline, wake is called when it passes.
+func (d *deadline) set(t time.Time, wake func()) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.t = t
+	if wait := time.Until(t); !t.IsZero() && wait > 0 {
+		d.timer = time.AfterFunc(wait, wake)
+	}
+}
+
+func (d *deadline) expired() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
@@ -0,0 +1,233 @@
+package routing
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tunneling/pkg/config"
+)
+
+// Route sends flows towards Prefix through Agent, the name of an agent or of
+// a group. HTTPMode is config.HTTPLenient or config.HTTPStrict.
+type Route struct {
+	Prefix   netip.Prefix
+	Agent    string
+	HTTPMode string
+}
+
+func (r Route) String() string {
+	if r.HTTPMode == config.HTTPStrict {
+		return r.Prefix.String() + " -> " + r.Agent + " (strict HTTP)"
+	}
+	return r.Prefix.String() + " -> " + r.Agent
+}
+
+// Group is a set of agents serving the same routes.
+type Group struct {
+	Name   string
+	Policy string
+	Agents []string
+
+	next atomic.Uint32
+}
+
+func (g *Group) String() string {
+	return fmt.Sprintf("%s (%s): %s", g.Name, g.Policy, strings.Join(g.Agents, ", "))
+}
+
+// order returns the group's agents, the one to try first at the front. load
+// gives the number of flows an agent is carrying.
+func (g *Group) order(load func(agent string) int) []string {
+	agents := slices.Clone(g.Agents)
+	switch g.Policy {
+	case config.PolicyLeastConn:
+		loads := make(map[string]int, len(agents))
+		for _, agent := range agents {
+			loads[agent] = load(agent)
+		}
+		slices.SortStableFunc(agents, func(a, b string) int {
+			return cmp.Compare(loads[a], loads[b])
+		})
+	case config.PolicyRoundRobin:
+		start := int(g.next.Add(1)-1) % len(agents)
+		agents = append(agents[start:], agents[:start]...)
+	}
+	return agents
+}
+
+// Table picks the agent for a destination by longest-prefix match. It is
+// safe for concurrent use and can be changed while flows are being routed.
+type Table struct {
+	mu sync.RWMutex
+	// routes is kept sorted by decreasing prefix length, so the first match
+	// is the longest one.
+	routes []Route
+	groups map[string]*Group
+}
+
+// New builds a table from the configured routes and groups. Without any
+// route every destination goes to config.AgentName.
+func New(cfg *config.Proxy) (*Table, error) {
+	t := &Table{}
+	if err := t.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload replaces routes and groups with the configured ones. The table is
+// left untouched if the configuration is invalid.
+func (t *Table) Reload(cfg *config.Proxy) error {
+	groups, err := parseGroups(cfg.Groups)
+	if err != nil {
+		return err
+	}
+	routes, err := parseRoutes(cfg.Routes)
+	if err != nil {
+		return err
+	}
+	sortRoutes(routes)
+	t.mu.Lock()
+	t.routes = routes
+	t.groups = groups
+	t.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the agent or group routed to dst, false if no route covers
+// it.
+func (t *Table) Lookup(dst netip.Addr) (string, bool) {
+	r, ok := t.route(dst)
+	return r.Agent, ok
+}
+
+// HTTPMode returns the HTTP mode of the route to dst, config.HTTPLenient if
+// no route covers it.
+func (t *Table) HTTPMode(dst netip.Addr) string {
+	if r, ok := t.route(dst); ok {
+		return r.HTTPMode
+	}
+	return config.HTTPLenient
+}
+
+func (t *Table) route(dst netip.Addr) (Route, bool) {
+	dst = dst.Unmap()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, r := range t.routes {
+		if r.Prefix.Contains(dst) {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// Candidates returns the agents that may carry a flow to dst, in the order
+// they should be tried.
+func (t *Table) Candidates(dst netip.Addr, load func(agent string) int) ([]string, bool) {
+	name, ok := t.Lookup(dst)
+	if !ok {
+		return nil, false
+	}
+	t.mu.RLock()
+	group := t.groups[name]
+	t.mu.RUnlock()
+	if group == nil {
+		return []string{name}, true
+	}
+	return group.order(load), true
+}
+
+func (t *Table) String() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var b strings.Builder
+	for _, r := range t.routes {
+		fmt.Fprintf(&b, "\t%s\n", r)
+	}
+	names := make([]string, 0, len(t.groups))
+	for name := range t.groups {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\tgroup %s\n", t.groups[name])
+	}
+	return b.String()
+}
+
+func parseRoutes(cfg []config.Route) ([]Route, error) {
+	if len(cfg) == 0 {
+		return []Route{
+			{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Agent: config.AgentName, HTTPMode: config.HTTPLenient},
+			{Prefix: netip.MustParsePrefix("::/0"), Agent: config.AgentName, HTTPMode: config.HTTPLenient},
+		}, nil
+	}
+
+	routes := make([]Route, 0, len(cfg))
+	seen := make(map[netip.Prefix]bool)
+	for _, entry := range cfg {
+		prefix, err := netip.ParsePrefix(entry.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("bad route %q: %w", entry.CIDR, err)
+		}
+		if entry.Agent == "" {
+			return nil, fmt.Errorf("route %s without an agent", entry.CIDR)
+		}
+		prefix = prefix.Masked()
+		if seen[prefix] {
+			return nil, fmt.Errorf("route %s listed twice", prefix)
+		}
+		mode := entry.HTTPMode
+		switch mode {
+		case "":
+			mode = config.HTTPLenient
+		case config.HTTPLenient, config.HTTPStrict:
+		default:
+			return nil, fmt.Errorf("unknown HTTP mode %q for route %s", entry.HTTPMode, prefix)
+		}
+		seen[prefix] = true
+		routes = append(routes, Route{Prefix: prefix, Agent: entry.Agent, HTTPMode: mode})
+	}
+	return routes, nil
+}
+
+func parseGroups(cfg []config.AgentGroup) (map[string]*Group, error) {
+	groups := make(map[string]*Group, len(cfg))
+	for _, entry := range cfg {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("agent group without a name")
+		}
+		if _, exists := groups[entry.Name]; exists {
+			return nil, fmt.Errorf("agent group %q listed twice", entry.Name)
+		}
+		if len(entry.Agents) == 0 {
+			return nil, fmt.Errorf("agent group %q without agents", entry.Name)
+		}
+		policy := entry.Policy
+		switch policy {
+		case "":
+			policy = config.PolicyRoundRobin
+		case config.PolicyRoundRobin, config.PolicyLeastConn, config.PolicyFailover:
+		default:
+			return nil, fmt.Errorf("unknown policy %q for agent group %q", entry.Policy, entry.Name)
+		}
+		groups[entry.Name] = &Group{
+			Name:   entry.Name,
+			Policy: policy,
+			Agents: slices.Clone(entry.Agents),
+		}
+	}
+	return groups, nil
+}
+
+func sortRoutes(routes []Route) {
+	slices.SortStableFunc(routes, func(a, b Route) int {
+		return b.Prefix.Bits() - a.Prefix.Bits()
+	})
+}
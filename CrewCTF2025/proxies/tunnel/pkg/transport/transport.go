@@ -0,0 +1,78 @@
+// Package transport carries the agent link between agent and proxy. Every
+// transport yields plain net.Conns, the protocol frames and the optional TLS
+// or Noise layer on top are the same whatever the transport.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/tunneling/pkg/config"
+)
+
+// Transport opens the proxy side of a transport and connects agents to it.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// TCP is the raw TCP transport.
+type TCP struct{}
+
+func (TCP) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCP) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Listen opens the proxy side of the transport cfg describes.
+func Listen(cfg config.Transport) (net.Listener, error) {
+	switch cfg.Type {
+	case "", config.TransportTCP:
+		return TCP{}.Listen(cfg.Listen)
+	case config.TransportWebSocket:
+		ws := &WebSocket{Path: cfg.Path}
+		if cfg.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load certificate: %w", err)
+			}
+			ws.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+		return ws.Listen(cfg.Listen)
+	}
+	return nil, fmt.Errorf("unknown transport: %q", cfg.Type)
+}
+
+// ForServer picks the transport for a server address given to an agent:
+// "host:port" or "tcp://host:port" for raw TCP, "ws://host:port/path" or
+// "wss://host:port/path" for WebSocket. It returns the address to dial. The
+// certificate of a wss server is checked against the system roots.
+func ForServer(server string) (Transport, string, error) {
+	scheme, rest, found := strings.Cut(server, "://")
+	if !found {
+		return TCP{}, server, nil
+	}
+	switch scheme {
+	case "tcp":
+		return TCP{}, rest, nil
+	case "ws", "wss":
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, "", err
+		}
+		ws := &WebSocket{Path: u.Path}
+		if scheme == "wss" {
+			ws.TLS = &tls.Config{}
+		}
+		return ws, u.Host, nil
+	}
+	return nil, "", fmt.Errorf("unknown transport scheme %q", scheme)
+}
@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket carries the agent link in binary WebSocket messages, for agents
+// that can only get out over HTTP. With TLS set it is served and dialed as
+// wss.
+type WebSocket struct {
+	// Path is the HTTP path of the endpoint, "/" when empty.
+	Path string
+	TLS  *tls.Config
+}
+
+func (w *WebSocket) path() string {
+	if w.Path == "" {
+		return "/"
+	}
+	return w.Path
+}
+
+func (w *WebSocket) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &wsListener{
+		ln:     ln,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(w.path(), websocket.Server{
+		// Agents are not browsers, there is no Origin to check
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.serve,
+	})
+	l.srv = &http.Server{Handler: mux, TLSConfig: w.TLS}
+
+	go func() {
+		var err error
+		if w.TLS != nil {
+			err = l.srv.ServeTLS(ln, "", "")
+		} else {
+			err = l.srv.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("WebSocket server failed", "addr", addr, "err", err)
+		}
+		l.Close()
+	}()
+	return l, nil
+}
+
+func (w *WebSocket) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	scheme, origin := "ws://", "http://"
+	if w.TLS != nil {
+		scheme, origin = "wss://", "https://"
+	}
+	cfg, err := websocket.NewConfig(scheme+addr+w.path(), origin+addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TlsConfig = w.TLS
+	ws, err := cfg.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// wsListener hands out the connections upgraded by its HTTP server.
+type wsListener struct {
+	ln        net.Listener
+	srv       *http.Server
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *wsListener) serve(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &wsConn{Conn: ws, done: make(chan struct{})}
+	if addr, err := netip.ParseAddrPort(ws.Request().RemoteAddr); err == nil {
+		conn.remote = net.TCPAddrFromAddrPort(addr)
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		return
+	}
+	// The server closes the connection once the handler returns
+	<-conn.done
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.srv.Close()
+	})
+	return nil
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// wsConn is a server side WebSocket connection. It reports the client's
+// address rather than its Origin.
+type wsConn struct {
+	*websocket.Conn
+	remote    net.Addr
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.done) })
+	return err
+}
@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tunneling/pkg/listener"
+	"github.com/tunneling/pkg/protocol"
+)
+
+// streamConn is a TCP connection through an agent.
+type streamConn struct {
+	*protocol.Stream
+	local, remote net.Addr
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// datagramConn is a connected UDP socket through an agent, each Read and
+// Write carries one datagram.
+type datagramConn struct {
+	session       *listener.DatagramSession
+	local, remote net.Addr
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	deadlineMoved chan struct{}
+}
+
+func newDatagramConn(session *listener.DatagramSession, local, remote net.Addr) *datagramConn {
+	return &datagramConn{
+		session:       session,
+		local:         local,
+		remote:        remote,
+		deadlineMoved: make(chan struct{}),
+	}
+}
+
+// Read returns the next datagram, truncated to the size of b.
+func (c *datagramConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline, moved := c.readDeadline, c.deadlineMoved
+		c.mu.Unlock()
+
+		if n, ok, err := c.readUntil(b, deadline, moved); ok {
+			return n, err
+		}
+	}
+}
+
+// readUntil waits for a datagram until deadline, ok is false if the
+// deadline was moved meanwhile.
+func (c *datagramConn) readUntil(b []byte, deadline time.Time, moved <-chan struct{}) (n int, ok bool, err error) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case data := <-c.session.Recv():
+		return copy(b, data), true, nil
+	case <-c.session.Done():
+		return 0, true, net.ErrClosed
+	case <-expired:
+		return 0, true, os.ErrDeadlineExceeded
+	case <-moved:
+		return 0, false, nil
+	}
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.session.Done():
+		return 0, net.ErrClosed
+	default:
+	}
+	if err := c.session.Send(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *datagramConn) Close() error {
+	c.session.Close()
+	return nil
+}
+
+func (c *datagramConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *datagramConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *datagramConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *datagramConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	close(c.deadlineMoved)
+	c.deadlineMoved = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never wait for the agent.
+func (c *datagramConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
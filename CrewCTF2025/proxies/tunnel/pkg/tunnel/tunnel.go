@@ -0,0 +1,146 @@
+// Package tunnel opens connections through the agents attached to this
+// process, without a TUN device. The process has to accept agents with
+// listener.SpawnListener first.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/listener"
+)
+
+// CONNECT_TIMEOUT bounds a dial whose context has no deadline.
+const CONNECT_TIMEOUT = 5 * time.Second
+
+var ErrNoAgent = errors.New("agent not connected")
+
+// Dial connects to addr on the named network ("tcp", "tcp4", "tcp6", "udp",
+// "udp4" or "udp6") through the named agent. A host name in addr is resolved
+// by the agent.
+func Dial(ctx context.Context, agent, network, addr string) (net.Conn, error) {
+	d := &Dialer{Agent: agent}
+	return d.DialContext(ctx, network, addr)
+}
+
+// Dialer connects through one agent. Its DialContext fits net/http,
+// database drivers and anything else taking a dial function.
+type Dialer struct {
+	// Agent is the name of the agent to go through, config.AgentName when
+	// empty.
+	Agent string
+	// Timeout bounds each dial, CONNECT_TIMEOUT when zero. A context
+	// deadline applies as well.
+	Timeout time.Duration
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: &Addr{Net: network, Agent: d.agent(), Host: addr}, Err: err}
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := lookupPort(network, portStr)
+	if err != nil {
+		return nil, err
+	}
+	var ip []byte
+	if a, err := netip.ParseAddr(host); err == nil {
+		ip = a.AsSlice()
+		host = ""
+	}
+
+	ac := listener.GetClient(d.agent())
+	if ac == nil {
+		return nil, ErrNoAgent
+	}
+	local := &Addr{Net: network, Agent: ac.Name}
+	remote := &Addr{Net: network, Agent: ac.Name, Host: addr}
+
+	if strings.HasPrefix(network, "udp") {
+		return newDatagramConn(ac.OpenDatagramSession(ip, host, port), local, remote), nil
+	}
+
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = CONNECT_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stream, err := ac.ConnectContext(ctx, ip, host, port)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{Stream: stream, local: local, remote: remote}, nil
+}
+
+func (d *Dialer) agent() string {
+	if d.Agent == "" {
+		return config.AgentName
+	}
+	return d.Agent
+}
+
+// Transport returns an http.Transport whose connections go through the
+// agent. TLS to the target is done on this side, end to end.
+func (d *Dialer) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+	return t
+}
+
+// RoundTripper returns an http.RoundTripper going through the named agent.
+func RoundTripper(agent string) http.RoundTripper {
+	d := &Dialer{Agent: agent}
+	return d.Transport()
+}
+
+// Addr is an address reached through an agent. The local end of a
+// connection has no Host and is named after the agent.
+type Addr struct {
+	Net   string
+	Agent string
+	Host  string
+}
+
+func (a *Addr) Network() string {
+	return a.Net
+}
+
+func (a *Addr) String() string {
+	if a.Host == "" {
+		return a.Agent
+	}
+	return a.Host
+}
+
+func lookupPort(network, port string) (uint16, error) {
+	if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+		return uint16(n), nil
+	}
+	n, err := net.LookupPort(network, port)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(n), nil
+}
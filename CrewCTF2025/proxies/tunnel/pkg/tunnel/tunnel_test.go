@@ -0,0 +1,262 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tunneling/pkg/config"
+	"github.com/tunneling/pkg/filter"
+	"github.com/tunneling/pkg/listener"
+	"github.com/tunneling/pkg/protocol"
+)
+
+// REFUSED_PORT is the port the test agent refuses to connect to.
+const REFUSED_PORT = 1
+
+// startAgent accepts agents on a local listener and attaches an in-process
+// agent named name, which echoes whatever it is sent on streams and
+// datagram sessions. Streams are numbered after their request.
+func startAgent(t *testing.T, name string) {
+	t.Helper()
+	startAgentWithIDs(t, name, func(reqID uint32) uint32 { return reqID })
+}
+
+// startAgentWithIDs is startAgent, numbering streams with streamID.
+func startAgentWithIDs(t *testing.T, name string, streamID func(reqID uint32) uint32) {
+	t.Helper()
+	registry, err := listener.NewRegistry(&config.Proxy{
+		DuplicateAgents: config.DuplicateReplace,
+		Agents:          []config.AgentCredential{{Name: name, Token: "secret"}},
+	}, filter.NewPipeline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := listener.SpawnListener(ctx, ln, registry, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "%s secret\n", name)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "OK ") {
+		t.Fatalf("handshake answered %q, %v", line, err)
+	}
+	go echoAgent(reader, protocol.NewSender(conn), streamID)
+
+	// The session is published right after the answer
+	for listener.GetClient(name) == nil {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// echoAgent serves the frames read from r until the connection is lost.
+func echoAgent(r io.Reader, sender *protocol.Sender, streamID func(reqID uint32) uint32) {
+	var mu sync.Mutex
+	streams := make(map[uint32]*protocol.Stream)
+	remove := func(id uint32) {
+		mu.Lock()
+		delete(streams, id)
+		mu.Unlock()
+	}
+	get := func(id uint32) *protocol.Stream {
+		mu.Lock()
+		defer mu.Unlock()
+		return streams[id]
+	}
+
+	dec := protocol.NewDecoder(r)
+	for dec.Decode() == nil {
+		switch m := dec.Payload.(type) {
+		case *protocol.ConnectRequest:
+			if m.Port == REFUSED_PORT {
+				sender.SendConnectResponse(false, 0, m.ID)
+				continue
+			}
+			id := streamID(m.ID)
+			mu.Lock()
+			if streams[id] == nil {
+				stream := protocol.NewStream(id, sender, remove)
+				streams[id] = stream
+				go func() {
+					io.Copy(stream, stream)
+					stream.Close()
+				}()
+			}
+			mu.Unlock()
+			sender.SendConnectResponse(true, id, m.ID)
+
+		case *protocol.DataPacket:
+			if stream := get(m.ID); stream != nil {
+				stream.Deliver(m.Data)
+			}
+
+		case *protocol.WindowUpdate:
+			if stream := get(m.ID); stream != nil {
+				stream.AddCredit(m.Increment)
+			}
+
+		case *protocol.CloseWriteRequest:
+			if stream := get(m.ID); stream != nil {
+				stream.RemoteCloseWrite()
+			}
+
+		case *protocol.CloseRequest:
+			if stream := get(m.ID); stream != nil {
+				stream.CloseWithError(protocol.ErrStreamClosed)
+			}
+
+		case *protocol.Datagram:
+			sender.SendDatagram(m.ID, nil, "", 0, m.Data)
+		}
+	}
+}
+
+func TestDialTCP(t *testing.T) {
+	startAgent(t, "agent-tcp")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, addr := range []string{"192.0.2.1:7", "[2001:db8::1]:7", "echo.test:7"} {
+		conn, err := Dial(ctx, "agent-tcp", "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.RemoteAddr().String(); got != addr {
+			t.Errorf("RemoteAddr() = %s, want %s", got, addr)
+		}
+		if got := conn.LocalAddr().String(); got != "agent-tcp" {
+			t.Errorf("LocalAddr() = %s, want agent-tcp", got)
+		}
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Errorf("%s echoed %q", addr, buf)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	startAgent(t, "agent-errors")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		agent, network, addr string
+		want                 error
+	}{
+		{"agent-errors", "tcp", fmt.Sprintf("192.0.2.1:%d", REFUSED_PORT), listener.ErrConnectRefused},
+		{"nobody", "tcp", "192.0.2.1:7", ErrNoAgent},
+		{"nobody", "udp", "192.0.2.1:7", ErrNoAgent},
+	}
+	for _, tt := range tests {
+		conn, err := Dial(ctx, tt.agent, tt.network, tt.addr)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Dial(%s, %s, %s) = %v, %v, want %v", tt.agent, tt.network, tt.addr, conn, err, tt.want)
+		}
+	}
+	var unknown net.UnknownNetworkError
+	if _, err := Dial(ctx, "agent-errors", "unix", "/tmp/sock"); !errors.As(err, &unknown) {
+		t.Errorf("Dial on unix = %v, want %T", err, unknown)
+	}
+}
+
+// An agent handing out an ID in use does not take over the live stream.
+func TestDialDuplicateStream(t *testing.T) {
+	startAgentWithIDs(t, "agent-duplicate", func(uint32) uint32 { return 7 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first, err := Dial(ctx, "agent-duplicate", "tcp", "192.0.2.1:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if conn, err := Dial(ctx, "agent-duplicate", "tcp", "192.0.2.2:7"); !errors.Is(err, listener.ErrConnectRefused) {
+		t.Fatalf("Dial with a duplicate ID = %v, %v, want %v", conn, err, listener.ErrConnectRefused)
+	}
+
+	if _, err := first.Write([]byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(first, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "still here" {
+		t.Errorf("first stream echoed %q", buf)
+	}
+}
+
+func TestDialUDP(t *testing.T) {
+	startAgent(t, "agent-udp")
+	conn, err := Dial(context.Background(), "agent-udp", "udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, msg := range []string{"first", "second"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Errorf("echoed %q, want %q", buf[:n], msg)
+		}
+	}
+
+	// Successive deadlines each expire on their own
+	for range 3 {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Read past the deadline = %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	}
+
+	// A deadline moved while Read waits wakes it up
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.SetReadDeadline(time.Now())
+	}()
+	if _, err := conn.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read after the deadline moved = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	conn.Close()
+	if _, err := conn.Read(make([]byte, 64)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after Close = %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -1,11 +1,8 @@
 package util
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
 	"fmt"
 	"net/netip"
-	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 )
@@ -32,13 +29,3 @@ func GetAddrPort(addr []byte, port uint16) (netip.AddrPort, error) {
 		return netip.AddrPort{}, fmt.Errorf("unrecognize addr: %s", addr)
 	}
 }
-
-func GenerateConnID(port int) uint32 {
-	iterations := port * 2
-	hash := sha256.Sum256(fmt.Appendf(nil, "%d", time.Now().UnixNano()))
-
-	for i := 0; i < iterations; i++ {
-		hash = sha256.Sum256(hash[:])
-	}
-	return binary.BigEndian.Uint32(hash[12:])
-}